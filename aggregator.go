@@ -0,0 +1,228 @@
+package main
+
+import (
+	"time"
+)
+
+// Metrics holds everything aggregated during one flush interval, keyed
+// by metric_key(). monitor() owns the live instance and swaps it for a
+// fresh one on every tick, so the snapshot can be flushed to the
+// backends without blocking ingestion.
+type Metrics struct {
+	counters map[string]float64
+	timers   map[string]*Sketch
+	gauges   map[string]*Gauge
+	sets     map[string]map[string]bool
+
+	// Flushes each metric has gone without an update, by modifier. A
+	// metric updated in this interval has no entry.
+	idle map[string]map[string]int
+
+	// Seconds covered by this snapshot, used for per-second rates.
+	interval float64
+	// The flush this snapshot was taken at, the timestamp of every value
+	// sent to the backends.
+	time time.Time
+}
+
+func NewMetrics() *Metrics {
+	var m Metrics
+	m.counters = make(map[string]float64)
+	m.timers = make(map[string]*Sketch)
+	m.gauges = make(map[string]*Gauge)
+	m.sets = make(map[string]map[string]bool)
+	m.idle = map[string]map[string]int{
+		"c":  make(map[string]int),
+		"g":  make(map[string]int),
+		"ms": make(map[string]int),
+		"s":  make(map[string]int),
+	}
+	return &m
+}
+
+func (m *Metrics) add(s *Packet) {
+	key := metric_key(s.Bucket, s.Tags)
+	if idle, ok := m.idle[s.Modifier]; ok {
+		delete(idle, key)
+	}
+	if s.Modifier == "ms" {
+		t, ok := m.timers[key]
+		if !ok || t == nil {
+			t = NewSketch(*timerAccuracy)
+			m.timers[key] = t
+		}
+		// A sample sent at rate r stands for 1/r samples.
+		t.add(s.Value, 1 / s.Sampling)
+	} else if s.Modifier == "s" {
+		_, ok := m.sets[key]
+		if !ok {
+			m.sets[key] = make(map[string]bool)
+		}
+		m.sets[key][s.Member] = true
+	} else if s.Modifier == "g" {
+		g, ok := m.gauges[key]
+		if !ok {
+			g = &Gauge{}
+			m.gauges[key] = g
+		}
+		g.set(s.Value, s.Relative)
+	} else {
+		m.counters[key] += s.Value / s.Sampling
+	}
+}
+
+// carryOver starts the next interval: every metric seen so far is kept,
+// counters at zero, timers and sets empty and gauges at their last
+// value, unless it has been idle for longer than its -expire-* flag.
+func (m *Metrics) carryOver() *Metrics {
+	next := NewMetrics()
+	for key := range m.counters {
+		if m.keep("c", key, *expireCounters, next) {
+			next.counters[key] = 0
+		}
+	}
+	for key := range m.timers {
+		if m.keep("ms", key, *expireTimers, next) {
+			next.timers[key] = nil
+		}
+	}
+	for key, g := range m.gauges {
+		if m.keep("g", key, *expireGauges, next) {
+			next.gauges[key] = &Gauge{value: g.value, relative: g.relative}
+		}
+	}
+	for key := range m.sets {
+		if m.keep("s", key, *expireSets, next) {
+			next.sets[key] = make(map[string]bool)
+		}
+	}
+	return next
+}
+
+// keep counts one more idle flush for a metric and tells whether it
+// survives into next. A negative limit keeps metrics forever; 0 drops
+// them as soon as they miss an interval.
+func (m *Metrics) keep(modifier string, key string, limit int, next *Metrics) bool {
+	n := m.idle[modifier][key] + 1
+	if limit >= 0 && n > limit {
+		return false
+	}
+	next.idle[modifier][key] = n
+	return true
+}
+
+// size is the number of series in m.
+func (m *Metrics) size() int {
+	return len(m.counters) + len(m.timers) + len(m.gauges) + len(m.sets)
+}
+
+func (m *Metrics) addInternalCounter(name string, v float64) {
+	m.add(&Packet{Bucket: "statsd-monitor." + name, Value: v, Modifier: "c", Sampling: 1})
+}
+
+func (m *Metrics) addInternalTiming(name string, d time.Duration) {
+	m.add(&Packet{Bucket: "statsd-monitor." + name, Value: float64(d) / float64(time.Millisecond), Modifier: "ms", Sampling: 1})
+}
+
+// merge folds o into m. Shards never share keys, but monitor's own
+// internal metrics may collide with ones sent by clients.
+func (m *Metrics) merge(o *Metrics) {
+	for key, c := range o.counters {
+		m.counters[key] += c
+	}
+	for key, t := range o.timers {
+		if m.timers[key] == nil {
+			m.timers[key] = t
+		} else if t != nil {
+			m.timers[key].merge(t)
+		}
+	}
+	for key, g := range o.gauges {
+		m.gauges[key] = g
+	}
+	for key, set := range o.sets {
+		_, ok := m.sets[key]
+		if !ok {
+			m.sets[key] = make(map[string]bool)
+		}
+		for member := range set {
+			m.sets[key][member] = true
+		}
+	}
+}
+
+const SHARD_QUEUE_SIZE = 10000
+
+// Shard aggregates the packets of the metrics hashed to it in its own
+// goroutine.
+type Shard struct {
+	in      chan Packet
+	swaps   chan chan *Metrics
+	metrics *Metrics
+}
+
+var shards []*Shard
+
+func startShards(n int) {
+	shards = make([]*Shard, n)
+	for i := range shards {
+		var sh Shard
+		sh.in = make(chan Packet, SHARD_QUEUE_SIZE)
+		sh.swaps = make(chan chan *Metrics)
+		sh.metrics = NewMetrics()
+		shards[i] = &sh
+		go sh.run()
+	}
+}
+
+func (sh *Shard) run() {
+	for {
+		select {
+		case p := <-sh.in:
+			sh.metrics.add(&p)
+		case reply := <-sh.swaps:
+			// Packets queued before the swap belong to this interval.
+			for n := len(sh.in); n > 0; n-- {
+				p := <-sh.in
+				sh.metrics.add(&p)
+			}
+			snapshot := sh.metrics
+			sh.metrics = snapshot.carryOver()
+			reply <- snapshot
+		}
+	}
+}
+
+// shardFor picks the shard of a packet by an FNV-1a hash of its bucket
+// and tags, so every packet of a series lands on the same shard.
+func shardFor(p *Packet) *Shard {
+	if len(shards) == 1 {
+		return shards[0]
+	}
+	h := uint32(2166136261)
+	for i := 0; i < len(p.Bucket); i++ {
+		h = (h ^ uint32(p.Bucket[i])) * 16777619
+	}
+	for _, tag := range p.Tags {
+		h = (h ^ ',') * 16777619
+		for i := 0; i < len(tag); i++ {
+			h = (h ^ uint32(tag[i])) * 16777619
+		}
+	}
+	return shards[h%uint32(len(shards))]
+}
+
+// swapShards takes a snapshot of every shard at once and merges them
+// into a single view.
+func swapShards() *Metrics {
+	replies := make([]chan *Metrics, len(shards))
+	for i, sh := range shards {
+		replies[i] = make(chan *Metrics, 1)
+		sh.swaps <- replies[i]
+	}
+	merged := NewMetrics()
+	for _, reply := range replies {
+		merged.merge(<-reply)
+	}
+	return merged
+}
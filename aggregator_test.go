@@ -0,0 +1,202 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func almost_equal(a, b float64) bool {
+	return math.Abs(a-b) <= 1e-6*math.Max(1, math.Abs(b))
+}
+
+func TestSampledTimerWeights(t *testing.T) {
+	timerPercentiles = []float64{50, 90}
+	for _, rate := range []float64{1, 0.5, 0.3, 0.01} {
+		m := NewMetrics()
+		for i := 0; i < 10; i++ {
+			m.add(&Packet{Bucket: "t", Value: 5, Modifier: "ms", Sampling: rate})
+		}
+		td := timer_distribution("t", m.timers["t"], 10)
+		want := 10 / rate
+		if !almost_equal(td.count, want) {
+			t.Errorf("rate %g: got count %f, want %f", rate, td.count, want)
+		}
+		if !almost_equal(td.count_ps, want/10) {
+			t.Errorf("rate %g: got count_ps %f, want %f", rate, td.count_ps, want/10)
+		}
+		if !almost_equal(td.mean, 5) || !almost_equal(td.sum, 5*want) {
+			t.Errorf("rate %g: got mean %f sum %f", rate, td.mean, td.sum)
+		}
+	}
+}
+
+func TestSampledTimerPercentiles(t *testing.T) {
+	timerPercentiles = []float64{50, 90, 95}
+	m := NewMetrics()
+	// 60 fast requests sent unsampled and one slow one sampled at 0.01:
+	// the slow one stands for 100 requests.
+	for i := 0; i < 60; i++ {
+		m.add(&Packet{Bucket: "t", Value: 1, Modifier: "ms", Sampling: 1})
+	}
+	m.add(&Packet{Bucket: "t", Value: 1000, Modifier: "ms", Sampling: 0.01})
+	// 30 medium requests sampled at 0.3 stand for 100.
+	for i := 0; i < 30; i++ {
+		m.add(&Packet{Bucket: "t", Value: 10, Modifier: "ms", Sampling: 0.3})
+	}
+	td := timer_distribution("t", m.timers["t"], 1)
+
+	if !almost_equal(td.count, 260) {
+		t.Errorf("got count %f, want 260", td.count)
+	}
+	want := []float64{10, 1000, 1000}
+	for i, p := range td.percentiles {
+		if math.Abs(p.v-want[i]) > *timerAccuracy*want[i] {
+			t.Errorf("p%g: got %f, want %f", p.p, p.v, want[i])
+		}
+	}
+	if !almost_equal(td.mean, (60+1000*100+10*100)/260.0) {
+		t.Errorf("got mean %f", td.mean)
+	}
+}
+
+func TestIdleExpiry(t *testing.T) {
+	defer func(c, g int) { *expireCounters, *expireGauges = c, g }(*expireCounters, *expireGauges)
+	*expireCounters, *expireGauges = 2, 0
+
+	m := NewMetrics()
+	m.add(&Packet{Bucket: "c", Value: 1, Modifier: "c", Sampling: 1})
+	m.add(&Packet{Bucket: "g", Value: 1, Modifier: "g", Sampling: 1})
+	m.add(&Packet{Bucket: "t", Value: 1, Modifier: "ms", Sampling: 1})
+
+	m = m.carryOver()
+	if _, ok := m.counters["c"]; !ok {
+		t.Errorf("counter expired after one idle flush")
+	}
+	if _, ok := m.gauges["g"]; ok {
+		t.Errorf("idle gauge kept with -expire-gauges=0")
+	}
+	m.add(&Packet{Bucket: "c", Value: 1, Modifier: "c", Sampling: 1})
+	m = m.carryOver()
+	m = m.carryOver()
+	if _, ok := m.counters["c"]; !ok {
+		t.Errorf("counter expired after two idle flushes")
+	}
+	m = m.carryOver()
+	if _, ok := m.counters["c"]; ok {
+		t.Errorf("counter kept after three idle flushes")
+	}
+	if _, ok := m.timers["t"]; !ok {
+		t.Errorf("timer expired with -expire-timers=-1")
+	}
+}
+
+func TestGaugeModes(t *testing.T) {
+	defer func(old gaugeModeFlags) { gaugeModes = old }(gaugeModes)
+	gaugeModes = nil
+	for _, flag := range []string{"queue.*=max", "*=all"} {
+		if err := gaugeModes.Set(flag); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m := NewMetrics()
+	for _, v := range []float64{5, 1, 9} {
+		m.add(&Packet{Bucket: "queue.depth", Value: v, Modifier: "g", Sampling: 1})
+	}
+	m.add(&Packet{Bucket: "pool", Value: 4, Modifier: "g", Sampling: 1})
+	m.add(&Packet{Bucket: "pool", Value: -2, Modifier: "g", Relative: true, Sampling: 1})
+
+	if s := gauge_stats("queue.depth", m.gauges["queue.depth"]).series(); len(s) != 1 || s[0].v != 9 {
+		t.Errorf("max mode: got %v", s)
+	}
+	gs := gauge_stats("pool", m.gauges["pool"])
+	want := []GaugeSeries{{"", 2}, {"min", 2}, {"max", 4}, {"avg", 3}}
+	if s := gs.series(); !reflect.DeepEqual(s, want) {
+		t.Errorf("all mode: got %v, want %v", s, want)
+	}
+
+	// An interval without writes reports the carried value everywhere.
+	m = m.carryOver()
+	want = []GaugeSeries{{"", 2}, {"min", 2}, {"max", 2}, {"avg", 2}}
+	if s := gauge_stats("pool", m.gauges["pool"]).series(); !reflect.DeepEqual(s, want) {
+		t.Errorf("idle interval: got %v, want %v", s, want)
+	}
+
+	if err := gaugeModes.Set("x=median"); err == nil {
+		t.Errorf("unknown mode accepted")
+	}
+}
+
+func TestSampledCounters(t *testing.T) {
+	m := NewMetrics()
+	m.add(&Packet{Bucket: "c", Value: 1, Modifier: "c", Sampling: 0.1})
+	m.add(&Packet{Bucket: "c", Value: 0.25, Modifier: "c", Sampling: 1})
+	m.add(&Packet{Bucket: "c", Value: 1, Modifier: "c", Sampling: 0.3})
+	if want := 10 + 0.25 + 1/0.3; !almost_equal(m.counters["c"], want) {
+		t.Errorf("got %f, want %f", m.counters["c"], want)
+	}
+}
+
+func shard_test_packets() []Packet {
+	var packets []Packet
+	for i := 0; i < 200; i++ {
+		bucket := "bucket" + strconv.Itoa(i%7)
+		var tags []string
+		if i%3 == 0 {
+			tags = []string{"host:" + strconv.Itoa(i%5)}
+		}
+		packets = append(packets,
+			Packet{Bucket: bucket, Value: float64(i), Modifier: "c", Sampling: 1, Tags: tags},
+			Packet{Bucket: bucket, Value: float64(i), Modifier: "g", Sampling: 1, Tags: tags},
+			Packet{Bucket: bucket, Value: float64(i % 50), Modifier: "ms", Sampling: 1, Tags: tags},
+			Packet{Bucket: bucket, Member: strconv.Itoa(i % 11), Modifier: "s", Sampling: 1, Tags: tags})
+	}
+	return packets
+}
+
+func TestShardsMatchSingleAggregator(t *testing.T) {
+	timerPercentiles = []float64{50, 90}
+	defer func(old []*Shard) { shards = old }(shards)
+
+	want := NewMetrics()
+	for _, p := range shard_test_packets() {
+		want.add(&p)
+	}
+
+	startShards(4)
+	for _, p := range shard_test_packets() {
+		enqueue(p)
+	}
+	got := swapShards()
+	if !reflect.DeepEqual(got.counters, want.counters) {
+		t.Errorf("counters: got %v, want %v", got.counters, want.counters)
+	}
+	if !reflect.DeepEqual(got.gauges, want.gauges) {
+		t.Errorf("gauges differ")
+	}
+	if !reflect.DeepEqual(got.timers, want.timers) {
+		t.Errorf("timers differ")
+	}
+	if !reflect.DeepEqual(got.sets, want.sets) {
+		t.Errorf("sets: got %v, want %v", got.sets, want.sets)
+	}
+}
+
+func TestSwapTakesQueuedPackets(t *testing.T) {
+	// The shard may see the swap before the packets queued ahead of it;
+	// they still belong to the snapshot.
+	for i := 0; i < 20; i++ {
+		sh := &Shard{in: make(chan Packet, 10), swaps: make(chan chan *Metrics, 1), metrics: NewMetrics()}
+		reply := make(chan *Metrics, 1)
+		sh.swaps <- reply
+		for j := 0; j < 10; j++ {
+			sh.in <- Packet{Bucket: "c", Value: 1, Modifier: "c", Sampling: 1}
+		}
+		go sh.run()
+		if got := (<-reply).counters["c"]; got != 10 {
+			t.Fatalf("got %f packets in the snapshot, want 10", got)
+		}
+	}
+}
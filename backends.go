@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// BackendType describes a kind of backend that can be declared in the
+// config file:
+//
+//	[[backend]]
+//	name = "graphite-dc1"
+//	type = "graphite"
+//	address = "dc1.graphite:2003"
+//	prefix = "dc1"
+type BackendType struct {
+	// Settings of the backend besides name and type; true if required.
+	options map[string]bool
+	// Only one backend of this type may be declared.
+	unique bool
+	build  func(c BackendConfig) (StatsdBackend, error)
+}
+
+// Backend is a backend instance with the name it was declared with.
+type Backend struct {
+	name   string
+	config BackendConfig
+	StatsdBackend
+
+	// Set while a flush goroutine is running for this backend; read and
+	// written with atomic.
+	busy int32
+}
+
+type BackendConfig struct {
+	name    string
+	kind    string
+	options map[string]string
+}
+
+var backendTypes = make(map[string]BackendType)
+
+// registerBackend makes a backend type available under kind. Called
+// from init() next to each backend.
+func registerBackend(kind string, t BackendType) {
+	backendTypes[kind] = t
+}
+
+// Backends declared in the config file. Without any, the -graphite,
+// -log-this and RRD backends of the flags are used.
+var backendConfigs []BackendConfig
+
+// backend_config checks a [[backend]] table of the config file.
+func backend_config(table *ConfigTable) (BackendConfig, error) {
+	c := BackendConfig{options: make(map[string]string)}
+	for key, values := range table.values {
+		if len(values) != 1 {
+			return c, fmt.Errorf("line %d: %s must be a single value", table.lines[key], key)
+		}
+		switch key {
+		case "name":
+			c.name = values[0]
+		case "type":
+			c.kind = values[0]
+		default:
+			c.options[key] = values[0]
+		}
+	}
+	if c.name == "" {
+		return c, fmt.Errorf("backend without a name")
+	}
+	if !is_valid_name([]byte(c.name)) {
+		return c, fmt.Errorf("line %d: bad backend name '%s'", table.lines["name"], c.name)
+	}
+	t, ok := backendTypes[c.kind]
+	if !ok {
+		return c, fmt.Errorf("backend %s: unknown type '%s' (known: %s)", c.name, c.kind, strings.Join(backend_kinds(), ", "))
+	}
+	for key := range c.options {
+		if _, ok := t.options[key]; !ok {
+			return c, fmt.Errorf("line %d: backend %s: unknown setting '%s'", table.lines[key], c.name, key)
+		}
+	}
+	for key, required := range t.options {
+		if _, ok := c.options[key]; required && !ok {
+			return c, fmt.Errorf("backend %s: %s is required", c.name, key)
+		}
+	}
+	return c, nil
+}
+
+// check_backends rejects duplicate names and second instances of unique
+// backend types.
+func check_backends(configs []BackendConfig) error {
+	names := make(map[string]bool)
+	kinds := make(map[string]bool)
+	for _, c := range configs {
+		if names[c.name] {
+			return fmt.Errorf("backend %s declared twice", c.name)
+		}
+		names[c.name] = true
+		if kinds[c.kind] && backendTypes[c.kind].unique {
+			return fmt.Errorf("backend %s: only one %s backend is allowed", c.name, c.kind)
+		}
+		kinds[c.kind] = true
+	}
+	return nil
+}
+
+func backend_kinds() []string {
+	var kinds []string
+	for kind := range backendTypes {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	return kinds
+}
+
+// backend_configs returns the backends to flush to: those of the config
+// file or else those of the flags.
+func backend_configs() []BackendConfig {
+	if len(backendConfigs) > 0 {
+		return backendConfigs
+	}
+	return flag_backends()
+}
+
+// find_backend returns the backend of backends declared as c, or nil.
+func find_backend(backends []*Backend, c BackendConfig) *Backend {
+	for _, bk := range backends {
+		if reflect.DeepEqual(bk.config, c) {
+			return bk
+		}
+	}
+	return nil
+}
+
+// flag_backends declares the backends of the command line flags.
+func flag_backends() []BackendConfig {
+	var configs []BackendConfig
+	if *graphiteAddress != "" {
+		configs = append(configs, BackendConfig{"graphite", "graphite", map[string]string{"address": *graphiteAddress, "prefix": *graphitePrefix}})
+	}
+	if *logThis != "" {
+		configs = append(configs, BackendConfig{"stdout", "stdout", map[string]string{"prefix": *logThis}})
+	}
+	configs = append(configs, BackendConfig{"rrd", "rrd", map[string]string{}})
+	return configs
+}
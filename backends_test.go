@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeBackend fails or panics on the metrics named so and counts the
+// others.
+type fakeBackend struct {
+	fail   string
+	panics string
+	delay  time.Duration
+	block  chan bool // if set, every write waits for it to be closed
+	stored int
+	ended  bool
+}
+
+func (b *fakeBackend) store(name string) error {
+	time.Sleep(b.delay)
+	if b.block != nil {
+		<-b.block
+	}
+	if name == b.panics {
+		panic("boom")
+	}
+	if name == b.fail {
+		return errors.New("cannot store " + name)
+	}
+	b.stored++
+	return nil
+}
+
+func (b *fakeBackend) beginAggregation(ctx context.Context, ts time.Time) error {
+	return nil
+}
+func (b *fakeBackend) handleCounter(name string, tags []string, count float64, count_ps float64) error {
+	return b.store(name)
+}
+func (b *fakeBackend) handleGauge(name string, tags []string, gs GaugeStats) error {
+	return b.store(name)
+}
+func (b *fakeBackend) handleTiming(name string, tags []string, td TimerDistribution) error {
+	return b.store(name)
+}
+func (b *fakeBackend) handleSet(name string, tags []string, count int64) error {
+	return b.store(name)
+}
+func (b *fakeBackend) endAggregation(ctx context.Context) error {
+	b.ended = true
+	return nil
+}
+
+func TestSubmitIsolatesBackends(t *testing.T) {
+	defer func(old int64) { *flushTimeout = old }(*flushTimeout)
+	*flushTimeout = 1
+
+	m := NewMetrics()
+	m.interval = 10
+	for _, name := range []string{"a", "b", "c"} {
+		m.add(&Packet{Bucket: name, Value: 1, Modifier: "c", Sampling: 1})
+	}
+	ok := &fakeBackend{}
+	failing := &fakeBackend{fail: "b"}
+	panicking := &fakeBackend{panics: "b"}
+	slow := &fakeBackend{delay: 600 * time.Millisecond}
+	backends := []*Backend{{name: "ok", StatsdBackend: ok}, {name: "failing", StatsdBackend: failing},
+		{name: "panicking", StatsdBackend: panicking}, {name: "slow", StatsdBackend: slow}}
+	results := submit(backends, m)
+	// The slow backend notices the deadline after its current write.
+	for atomic.LoadInt32(&backends[3].busy) != 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if results[0].name != "ok" || results[0].err != nil || ok.stored != 3 || !ok.ended {
+		t.Errorf("ok: got %+v, stored %d", results[0], ok.stored)
+	}
+	if results[1].err == nil || failing.stored != 2 || !failing.ended {
+		t.Errorf("failing: got %+v, stored %d", results[1], failing.stored)
+	}
+	if results[2].err == nil || !strings.Contains(results[2].err.Error(), "panic") {
+		t.Errorf("panicking: got %+v", results[2])
+	}
+	if results[3].err == nil || slow.stored == 3 || !slow.ended {
+		t.Errorf("slow: got %+v, stored %d", results[3], slow.stored)
+	}
+}
+
+func TestSubmitDoesNotWaitForHungBackend(t *testing.T) {
+	defer func(old int64) { *flushTimeout = old }(*flushTimeout)
+	*flushTimeout = 1
+
+	m := NewMetrics()
+	m.interval = 10
+	m.add(&Packet{Bucket: "a", Value: 1, Modifier: "c", Sampling: 1})
+	ok := &fakeBackend{}
+	hung := &fakeBackend{block: make(chan bool)}
+	backends := []*Backend{{name: "ok", StatsdBackend: ok}, {name: "hung", StatsdBackend: hung}}
+
+	start := time.Now()
+	results := submit(backends, m)
+	if d := time.Since(start); d > 1500*time.Millisecond {
+		t.Errorf("submit took %s with a 1s timeout", d)
+	}
+	if results[0].err != nil || ok.stored != 1 {
+		t.Errorf("ok: got %+v, stored %d", results[0], ok.stored)
+	}
+	if results[1].err == nil || !strings.Contains(results[1].err.Error(), "timed out") {
+		t.Errorf("hung: got %+v", results[1])
+	}
+
+	// The next flush skips the hung backend instead of calling it again.
+	results = submit(backends, m)
+	if results[0].err != nil || ok.stored != 2 {
+		t.Errorf("ok: got %+v, stored %d", results[0], ok.stored)
+	}
+	if results[1].err == nil || !strings.Contains(results[1].err.Error(), "busy") {
+		t.Errorf("hung: got %+v", results[1])
+	}
+
+	close(hung.block)
+	for atomic.LoadInt32(&backends[1].busy) != 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestBuildBackendsKeepsUnchanged(t *testing.T) {
+	a := BackendConfig{"a", "stdout", map[string]string{"prefix": "a."}}
+	b := BackendConfig{"b", "stdout", map[string]string{"prefix": "b."}}
+	old, err := buildBackends([]BackendConfig{a, b}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b2 := BackendConfig{"b", "stdout", map[string]string{"prefix": "c."}}
+	backends, err := buildBackends([]BackendConfig{b2, a}, old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if backends[1] != old[0] {
+		t.Errorf("unchanged backend a was rebuilt")
+	}
+	if backends[0] == old[1] {
+		t.Errorf("changed backend b was kept")
+	}
+}
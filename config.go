@@ -0,0 +1,433 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// The config file is a small subset of TOML: "key = value" lines,
+// [section] and [[section]] headers, and values that are strings,
+// numbers, booleans or arrays of those. Every setting names a flag:
+// "address = ':8125'" at the top sets -address, and "dir" under [rrd]
+// sets -rrd-dir. Flags given on the command line win over the file.
+// [[backend]] tables declare backends, see BackendType.
+//
+//	flush-interval = 10
+//	percentiles = [50, 90, 99]
+//	drop = ["debug.*"]
+//
+//	[rrd]
+//	dir = "/var/lib/statsd-monitor"
+//	retention = "10s:4h,5m:31d,1h:1y"
+
+// ConfigTable is one [section] or [[section]] of a config file; the
+// settings before the first header are in a table with an empty name.
+type ConfigTable struct {
+	name   string
+	values map[string][]string
+	lines  map[string]int
+}
+
+func newConfigTable(name string) *ConfigTable {
+	return &ConfigTable{name: name, values: make(map[string][]string), lines: make(map[string]int)}
+}
+
+type configScanner struct {
+	data []byte
+	pos  int
+	line int
+}
+
+func (s *configScanner) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("line %d: %s", s.line, fmt.Sprintf(format, args...))
+}
+
+func (s *configScanner) peek() byte {
+	if s.pos < len(s.data) {
+		return s.data[s.pos]
+	}
+	return 0
+}
+
+func (s *configScanner) skipSpace() {
+	for s.peek() == ' ' || s.peek() == '\t' {
+		s.pos++
+	}
+}
+
+// skipBlank skips spaces, comments and newlines.
+func (s *configScanner) skipBlank() {
+	for {
+		s.skipSpace()
+		switch s.peek() {
+		case '#':
+			for s.pos < len(s.data) && s.data[s.pos] != '\n' {
+				s.pos++
+			}
+		case '\r':
+			s.pos++
+		case '\n':
+			s.pos++
+			s.line++
+		default:
+			return
+		}
+	}
+}
+
+// endOfLine accepts a comment and the end of a line.
+func (s *configScanner) endOfLine() error {
+	s.skipSpace()
+	if s.peek() == '#' {
+		for s.pos < len(s.data) && s.data[s.pos] != '\n' {
+			s.pos++
+		}
+	}
+	if s.peek() == '\r' {
+		s.pos++
+	}
+	if s.pos < len(s.data) && s.data[s.pos] != '\n' {
+		return s.errorf("unexpected '%c'", s.data[s.pos])
+	}
+	return nil
+}
+
+func is_key_char(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-'
+}
+
+func (s *configScanner) key() (string, error) {
+	start := s.pos
+	for s.pos < len(s.data) && is_key_char(s.data[s.pos]) {
+		s.pos++
+	}
+	if s.pos == start {
+		return "", s.errorf("expected a name")
+	}
+	return string(s.data[start:s.pos]), nil
+}
+
+// value reads a scalar or an array, which is flattened into values.
+func (s *configScanner) value(values []string) ([]string, error) {
+	switch c := s.peek(); {
+	case c == '[':
+		s.pos++
+		for {
+			s.skipBlank()
+			if s.peek() == ']' {
+				s.pos++
+				return values, nil
+			}
+			if s.peek() == '[' {
+				return nil, s.errorf("nested arrays are not supported")
+			}
+			var err error
+			values, err = s.value(values)
+			if err != nil {
+				return nil, err
+			}
+			s.skipBlank()
+			if s.peek() == ',' {
+				s.pos++
+			} else if s.peek() != ']' {
+				return nil, s.errorf("expected ',' or ']' in array")
+			}
+		}
+	case c == '"' || c == '\'':
+		str, err := s.str(c)
+		if err != nil {
+			return nil, err
+		}
+		return append(values, str), nil
+	default:
+		start := s.pos
+		for s.pos < len(s.data) && strings.IndexByte(" \t\r\n,]#", s.data[s.pos]) < 0 {
+			s.pos++
+		}
+		word := string(s.data[start:s.pos])
+		if word == "true" || word == "false" {
+			return append(values, word), nil
+		}
+		if _, err := strconv.ParseFloat(strings.Replace(word, "_", "", -1), 64); err != nil {
+			return nil, s.errorf("bad value '%s' (strings need quotes)", word)
+		}
+		return append(values, strings.Replace(word, "_", "", -1)), nil
+	}
+}
+
+// str reads a quoted string. Double-quoted strings know the escapes
+// \", \\, \n and \t; single-quoted ones are taken literally.
+func (s *configScanner) str(quote byte) (string, error) {
+	s.pos++
+	var b strings.Builder
+	for {
+		if s.pos >= len(s.data) || s.data[s.pos] == '\n' {
+			return "", s.errorf("unterminated string")
+		}
+		c := s.data[s.pos]
+		s.pos++
+		if c == quote {
+			return b.String(), nil
+		}
+		if c == '\\' && quote == '"' && s.pos < len(s.data) {
+			switch s.data[s.pos] {
+			case '"', '\\':
+				c = s.data[s.pos]
+			case 'n':
+				c = '\n'
+			case 't':
+				c = '\t'
+			default:
+				return "", s.errorf("unknown escape '\\%c'", s.data[s.pos])
+			}
+			s.pos++
+		}
+		b.WriteByte(c)
+	}
+}
+
+func parse_config(data []byte) ([]*ConfigTable, error) {
+	s := &configScanner{data: data, line: 1}
+	table := newConfigTable("")
+	tables := []*ConfigTable{table}
+	seen := make(map[string]bool)
+	for {
+		s.skipBlank()
+		if s.pos >= len(s.data) {
+			return tables, nil
+		}
+		if s.peek() == '[' {
+			s.pos++
+			array := s.peek() == '['
+			if array {
+				s.pos++
+			}
+			s.skipSpace()
+			name, err := s.key()
+			if err != nil {
+				return nil, err
+			}
+			s.skipSpace()
+			end := "]"
+			if array {
+				end = "]]"
+			}
+			if !strings.HasPrefix(string(s.data[s.pos:]), end) {
+				return nil, s.errorf("expected '%s'", end)
+			}
+			s.pos += len(end)
+			if err := s.endOfLine(); err != nil {
+				return nil, err
+			}
+			if !array {
+				if seen[name] {
+					return nil, s.errorf("section [%s] defined twice", name)
+				}
+				seen[name] = true
+			}
+			table = newConfigTable(name)
+			tables = append(tables, table)
+			continue
+		}
+
+		name, err := s.key()
+		if err != nil {
+			return nil, err
+		}
+		s.skipSpace()
+		if s.peek() != '=' {
+			return nil, s.errorf("expected '=' after '%s'", name)
+		}
+		s.pos++
+		s.skipSpace()
+		if _, ok := table.values[name]; ok {
+			return nil, s.errorf("'%s' set twice", name)
+		}
+		line := s.line
+		values, err := s.value([]string{})
+		if err != nil {
+			return nil, err
+		}
+		if err := s.endOfLine(); err != nil {
+			return nil, err
+		}
+		table.values[name] = values
+		table.lines[name] = line
+	}
+}
+
+var configFile = flag.String("config", "", "Read settings from this file; flags given on the command line win, and SIGHUP reloads it")
+
+// Settings that take effect on SIGHUP; the rest need a restart.
+var reloadable = map[string]bool{
+	"drop":            true,
+	"graphite":        true,
+	"graphite-prefix": true,
+	"log-this":        true,
+}
+
+// Flags given on the command line, which the config file cannot change.
+var commandLine = make(map[string]bool)
+
+// repeatedFlag is a flag that may be given several times; a config file
+// array sets it once per element.
+type repeatedFlag interface {
+	flag.Value
+	reset()
+}
+
+type Config struct {
+	settings map[string][]string // flag values by flag name
+	backends []BackendConfig
+}
+
+// load_config reads the config file and checks it against the flags and
+// backend types without changing anything.
+func load_config(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	tables, err := parse_config(data)
+	if err != nil {
+		return nil, err
+	}
+	settings := make(map[string][]string)
+	var backends []BackendConfig
+	for _, table := range tables {
+		if table.name == "backend" {
+			c, err := backend_config(table)
+			if err != nil {
+				return nil, err
+			}
+			backends = append(backends, c)
+			continue
+		}
+		for key, values := range table.values {
+			name := key
+			if table.name != "" {
+				name = table.name + "-" + key
+			}
+			f := flag.Lookup(name)
+			if f == nil || name == "config" {
+				return nil, fmt.Errorf("line %d: unknown setting '%s'", table.lines[key], name)
+			}
+			if _, err := flag_value(f, values); err != nil {
+				return nil, fmt.Errorf("line %d: %s: %s", table.lines[key], name, err.Error())
+			}
+			settings[name] = values
+		}
+	}
+	if err := check_backends(backends); err != nil {
+		return nil, err
+	}
+	return &Config{settings, backends}, nil
+}
+
+// flag_value parses values into a new flag.Value of the same kind as f.
+// A list for a flag that is not repeated is joined with commas, as in
+// -percentiles.
+func flag_value(f *flag.Flag, values []string) (flag.Value, error) {
+	v := reflect.New(reflect.TypeOf(f.Value).Elem()).Interface().(flag.Value)
+	if _, ok := v.(repeatedFlag); !ok {
+		return v, v.Set(strings.Join(values, ","))
+	}
+	for _, value := range values {
+		if err := v.Set(value); err != nil {
+			return nil, err
+		}
+	}
+	return v, nil
+}
+
+func set_flag(f *flag.Flag, values []string) {
+	if r, ok := f.Value.(repeatedFlag); ok {
+		r.reset()
+		for _, value := range values {
+			r.Set(value)
+		}
+	} else {
+		f.Value.Set(strings.Join(values, ","))
+	}
+}
+
+// apply_config sets the flags of a config file that were not given on
+// the command line. Must be called right after flag.Parse().
+func apply_config(path string) error {
+	flag.Visit(func(f *flag.Flag) {
+		commandLine[f.Name] = true
+	})
+	config, err := load_config(path)
+	if err != nil {
+		return err
+	}
+	for name, values := range config.settings {
+		if !commandLine[name] {
+			set_flag(flag.Lookup(name), values)
+		}
+	}
+	backendConfigs = config.backends
+	return nil
+}
+
+// reload_config rereads the config file and applies the reloadable
+// settings, returning the backends to use from now on and whether it did.
+// Settings removed from the file return to their defaults; backends
+// whose declaration did not change are kept from old.
+func reload_config(old []*Backend) ([]*Backend, bool) {
+	config, err := load_config(*configFile)
+	if err != nil {
+		log.Printf("Not reloading %s: %s", *configFile, err.Error())
+		return nil, false
+	}
+	// Declared backends are built before anything changes, so that one
+	// that fails leaves the running setup alone.
+	var backends []*Backend
+	if len(config.backends) > 0 {
+		backends, err = buildBackends(config.backends, old)
+		if err != nil {
+			log.Printf("Not reloading %s: %s", *configFile, err.Error())
+			return nil, false
+		}
+	}
+	flag.VisitAll(func(f *flag.Flag) {
+		if commandLine[f.Name] || f.Name == "config" {
+			return
+		}
+		values, ok := config.settings[f.Name]
+		if !reloadable[f.Name] {
+			if ok {
+				v, _ := flag_value(f, values)
+				if v.String() != f.Value.String() {
+					log.Printf("Setting %s changed, restart to apply it", f.Name)
+				}
+			}
+			return
+		}
+		if !ok {
+			values = nil
+			if f.DefValue != "" {
+				values = []string{f.DefValue}
+			}
+		}
+		set_flag(f, values)
+	})
+	storeFilters()
+	backendConfigs = config.backends
+	if backends == nil {
+		// The backends of the flags only depend on settings checked by
+		// load_config, or on ones that need a restart.
+		backends, err = buildBackends(flag_backends(), old)
+		if err != nil {
+			log.Printf("Not reloading the backends of %s: %s", *configFile, err.Error())
+			return nil, false
+		}
+	}
+	log.Printf("Reloaded %s", *configFile)
+	return backends, true
+}
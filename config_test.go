@@ -0,0 +1,183 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseConfig(t *testing.T) {
+	tables, err := parse_config([]byte(`# statsd-monitor
+address = ":8125"   # UDP
+flush-interval = 10
+percentiles = [50, 90,
+    99.9,  # tail
+]
+log-this = 'api.\d'
+
+[rrd]
+dir = "/var/lib/\"rrd\""
+
+[[backend]]
+name = "a"
+[[backend]]
+name = "b"
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		name   string
+		values map[string][]string
+	}{
+		{"", map[string][]string{
+			"address":        {":8125"},
+			"flush-interval": {"10"},
+			"percentiles":    {"50", "90", "99.9"},
+			"log-this":       {`api.\d`},
+		}},
+		{"rrd", map[string][]string{"dir": {`/var/lib/"rrd"`}}},
+		{"backend", map[string][]string{"name": {"a"}}},
+		{"backend", map[string][]string{"name": {"b"}}},
+	}
+	if len(tables) != len(want) {
+		t.Fatalf("got %d tables, want %d", len(tables), len(want))
+	}
+	for i, table := range tables {
+		if table.name != want[i].name || !reflect.DeepEqual(table.values, want[i].values) {
+			t.Errorf("table %d: got [%s] %v, want [%s] %v", i, table.name, table.values, want[i].name, want[i].values)
+		}
+	}
+
+	for _, bad := range []string{
+		"address",
+		"address = unquoted",
+		"address = \"open",
+		"a = 1\na = 2",
+		"[rrd]\n[rrd]",
+		"[rrd",
+		"a = [1, [2]]",
+		"a = 1 b = 2",
+	} {
+		if _, err := parse_config([]byte(bad)); err == nil {
+			t.Errorf("%q: no error", bad)
+		}
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "statsd-monitor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.toml")
+
+	ioutil.WriteFile(path, []byte("percentiles = [50, 99]\ndrop = ['a.*', 'b.*']\n[rrd]\nstep = 60\n"), 0644)
+	config, err := load_config(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]string{"percentiles": {"50", "99"}, "drop": {"a.*", "b.*"}, "rrd-step": {"60"}}
+	if !reflect.DeepEqual(config.settings, want) {
+		t.Errorf("got %v, want %v", config.settings, want)
+	}
+
+	for _, bad := range []string{"no-such-flag = 1", "flush-interval = 'soon'", "drop = ['[']", "histogram = 'api.*=10,50,10'"} {
+		ioutil.WriteFile(path, []byte(bad), 0644)
+		if _, err := load_config(path); err == nil {
+			t.Errorf("%q: no error", bad)
+		}
+	}
+}
+
+func TestParseRetention(t *testing.T) {
+	archives, err := parse_retention("10s:4h,5m:31d,1h:1y", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []RrdArchive{{1, 1440}, {30, 8928}, {360, 8760}}
+	if !reflect.DeepEqual(archives, want) {
+		t.Errorf("got %v, want %v", archives, want)
+	}
+	for _, bad := range []string{"", "10s", "15s:1h", "1h:10m", "10x:1h", "-10s:1h"} {
+		if _, err := parse_retention(bad, 10); err == nil {
+			t.Errorf("%q: no error", bad)
+		}
+	}
+}
+
+func TestLoadConfigBackends(t *testing.T) {
+	dir, err := ioutil.TempDir("", "statsd-monitor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.toml")
+
+	ioutil.WriteFile(path, []byte(`
+[[backend]]
+name = "dc1"
+type = "graphite"
+address = "dc1:2003"
+prefix = "dc1"
+
+[[backend]]
+name = "dc2"
+type = "graphite"
+address = "dc2:2003"
+`), 0644)
+	config, err := load_config(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []BackendConfig{
+		{"dc1", "graphite", map[string]string{"address": "dc1:2003", "prefix": "dc1"}},
+		{"dc2", "graphite", map[string]string{"address": "dc2:2003"}},
+	}
+	if !reflect.DeepEqual(config.backends, want) {
+		t.Errorf("got %v, want %v", config.backends, want)
+	}
+
+	for _, bad := range []string{
+		"[[backend]]\ntype = 'rrd'",
+		"[[backend]]\nname = 'x'\ntype = 'carbon'",
+		"[[backend]]\nname = 'a b'\ntype = 'rrd'",
+		"[[backend]]\nname = '../x'\ntype = 'rrd'",
+		"[[backend]]\nname = 'x'\ntype = 'graphite'",
+		"[[backend]]\nname = 'x'\ntype = 'rrd'\ndir = 'data'",
+		"[[backend]]\nname = 'x'\ntype = 'stdout'\nprefix = ['a', 'b']",
+		"[[backend]]\nname = 'x'\ntype = 'rrd'\n[[backend]]\nname = 'x'\ntype = 'stdout'\nprefix = 'a'",
+		"[[backend]]\nname = 'x'\ntype = 'rrd'\n[[backend]]\nname = 'y'\ntype = 'rrd'",
+	} {
+		ioutil.WriteFile(path, []byte(bad), 0644)
+		if _, err := load_config(path); err == nil {
+			t.Errorf("%q: no error", bad)
+		}
+	}
+}
+
+func TestReloadKeepsBackendsOnError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "statsd-monitor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.toml")
+	defer func(file, retention string, configs []BackendConfig) {
+		*configFile, *rrdRetention, backendConfigs = file, retention, configs
+	}(*configFile, *rrdRetention, backendConfigs)
+	*configFile = path
+	*rrdRetention = "15s:1h"
+	backendConfigs = nil
+
+	ioutil.WriteFile(path, []byte("[[backend]]\nname = 'x'\ntype = 'rrd'\n"), 0644)
+	if _, ok := reload_config(nil); ok {
+		t.Errorf("reloaded with a bad -rrd-retention")
+	}
+	if backendConfigs != nil {
+		t.Errorf("backends changed to %v", backendConfigs)
+	}
+}
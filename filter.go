@@ -0,0 +1,53 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"path"
+	"strings"
+	"sync/atomic"
+)
+
+// patternList collects repeated glob flags such as -drop 'debug.*'.
+type patternList []string
+
+func (p *patternList) String() string {
+	return strings.Join(*p, " ")
+}
+
+func (p *patternList) Set(value string) error {
+	if _, err := path.Match(value, ""); err != nil {
+		return fmt.Errorf("bad pattern '%s'", value)
+	}
+	*p = append(*p, value)
+	return nil
+}
+
+func (p *patternList) reset() {
+	*p = nil
+}
+
+var dropPatterns patternList
+
+// The -drop patterns in use by the parse workers. The config reload
+// replaces them as a whole.
+var dropFilter atomic.Value
+
+func init() {
+	flag.Var(&dropPatterns, "drop", "Discard metrics whose name matches this pattern, e.g. 'debug.*' (may be repeated)")
+}
+
+// storeFilters publishes the current -drop patterns to the parse workers.
+func storeFilters() {
+	dropFilter.Store(append(patternList(nil), dropPatterns...))
+}
+
+func is_dropped(name string) bool {
+	patterns, _ := dropFilter.Load().(patternList)
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
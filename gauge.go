@@ -0,0 +1,160 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// How the writes to a gauge within one flush interval are combined.
+const (
+	GAUGE_LAST = "last"
+	GAUGE_MIN  = "min"
+	GAUGE_MAX  = "max"
+	GAUGE_AVG  = "avg"
+	GAUGE_ALL  = "all" // last as the gauge itself plus .min, .max and .avg
+)
+
+// GaugeConfig aggregates the gauges whose name matches pattern (a glob,
+// e.g. "queue.*.depth") with mode.
+type GaugeConfig struct {
+	pattern string
+	mode    string
+}
+
+// gaugeModeFlags collects repeated -gauge-mode 'pattern=mode' flags.
+type gaugeModeFlags []GaugeConfig
+
+func (g *gaugeModeFlags) String() string {
+	parts := make([]string, len(*g))
+	for i, c := range *g {
+		parts[i] = c.pattern + "=" + c.mode
+	}
+	return strings.Join(parts, " ")
+}
+
+func (g *gaugeModeFlags) Set(value string) error {
+	c, err := parse_gauge_mode(value)
+	if err != nil {
+		return err
+	}
+	*g = append(*g, c)
+	return nil
+}
+
+func (g *gaugeModeFlags) reset() {
+	*g = nil
+}
+
+func parse_gauge_mode(value string) (GaugeConfig, error) {
+	var c GaugeConfig
+	eq := strings.LastIndex(value, "=")
+	if eq <= 0 {
+		return c, fmt.Errorf("expected pattern=mode in '%s'", value)
+	}
+	c.pattern = value[:eq]
+	if _, err := path.Match(c.pattern, ""); err != nil {
+		return c, fmt.Errorf("bad pattern '%s'", c.pattern)
+	}
+	c.mode = strings.TrimSpace(value[eq+1:])
+	switch c.mode {
+	case GAUGE_LAST, GAUGE_MIN, GAUGE_MAX, GAUGE_AVG, GAUGE_ALL:
+	default:
+		return c, fmt.Errorf("unknown gauge mode '%s'", c.mode)
+	}
+	return c, nil
+}
+
+var gaugeModes gaugeModeFlags
+
+func init() {
+	flag.Var(&gaugeModes, "gauge-mode", "Aggregate gauges matching a pattern with last, min, max, avg or all, e.g. 'queue.*=max' (may be repeated, the first match wins; default last)")
+}
+
+// gauge_mode returns the aggregation mode configured for a gauge.
+func gauge_mode(name string) string {
+	for _, c := range gaugeModes {
+		if ok, _ := path.Match(c.pattern, name); ok {
+			return c.mode
+		}
+	}
+	return GAUGE_LAST
+}
+
+// Gauge is the state of a gauge during one flush interval.
+type Gauge struct {
+	value    float64 // the last value, carried over to the next interval
+	relative bool    // the last write was a delta
+
+	// Statistics of the values the gauge took in this interval.
+	count float64
+	min   float64
+	max   float64
+	sum   float64
+}
+
+func (g *Gauge) set(v float64, relative bool) {
+	if relative {
+		v += g.value
+	}
+	g.value = v
+	g.relative = relative
+	if g.count == 0 || v < g.min {
+		g.min = v
+	}
+	if g.count == 0 || v > g.max {
+		g.max = v
+	}
+	g.count++
+	g.sum += v
+}
+
+// GaugeStats is what the backends get for a gauge.
+type GaugeStats struct {
+	mode     string
+	last     float64
+	min      float64
+	max      float64
+	avg      float64
+	relative bool
+}
+
+func gauge_stats(name string, g *Gauge) GaugeStats {
+	gs := GaugeStats{mode: gauge_mode(name), last: g.value, min: g.value, max: g.value, avg: g.value, relative: g.relative}
+	if g.count > 0 {
+		gs.min = g.min
+		gs.max = g.max
+		gs.avg = g.sum / g.count
+	}
+	return gs
+}
+
+type GaugeSeries struct {
+	suffix string // appended to the gauge name after a dot, if not empty
+	v      float64
+}
+
+// series lists the values to store for a gauge: the one chosen by its
+// mode, or all of them for GAUGE_ALL.
+func (gs GaugeStats) series() []GaugeSeries {
+	switch gs.mode {
+	case GAUGE_MIN:
+		return []GaugeSeries{{"", gs.min}}
+	case GAUGE_MAX:
+		return []GaugeSeries{{"", gs.max}}
+	case GAUGE_AVG:
+		return []GaugeSeries{{"", gs.avg}}
+	case GAUGE_ALL:
+		return []GaugeSeries{{"", gs.last}, {"min", gs.min}, {"max", gs.max}, {"avg", gs.avg}}
+	}
+	return []GaugeSeries{{"", gs.last}}
+}
+
+// series_name appends the suffix of a gauge series to the gauge name.
+func series_name(name string, s GaugeSeries) string {
+	if s.suffix == "" {
+		return name
+	}
+	return name + "." + s.suffix
+}
@@ -2,55 +2,125 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"fmt"
-	"log"
 	"net"
+	"strings"
 	"time"
 )
 
 type GraphiteBackend struct {
+    prefix string
     now int64
     buffer *bytes.Buffer
     clientGraphite net.Conn
     graphiteAddress string
 }
 
-func NewGraphiteBackend(graphiteAddress string) *GraphiteBackend {
+func NewGraphiteBackend(graphiteAddress string, prefix string) *GraphiteBackend {
     var b GraphiteBackend
     b.graphiteAddress = graphiteAddress
+    if prefix != "" {
+        b.prefix = strings.TrimSuffix(prefix, ".") + "."
+    }
     return &b
 }
 
-func (b *GraphiteBackend) beginAggregation() {
+func init() {
+    registerBackend("graphite", BackendType{
+        options: map[string]bool{"address": true, "prefix": false},
+        build: func(c BackendConfig) (StatsdBackend, error) {
+            return NewGraphiteBackend(c.options["address"], c.options["prefix"]), nil
+        },
+    })
+}
+
+// printf writes a line starting with the prefix of the backend.
+func (b *GraphiteBackend) printf(format string, args ...interface{}) {
+    b.buffer.WriteString(b.prefix)
+    fmt.Fprintf(b.buffer, format, args...)
+}
+
+func (b *GraphiteBackend) beginAggregation(ctx context.Context, ts time.Time) error {
     var err error
-	b.now = time.Now().Unix()
+	b.now = ts.Unix()
     b.buffer = bytes.NewBufferString("")
-    b.clientGraphite, err = net.Dial(TCP, b.graphiteAddress)
+    var d net.Dialer
+    b.clientGraphite, err = d.DialContext(ctx, TCP, b.graphiteAddress)
     if err != nil {
-        log.Printf(err.Error())
+        return fmt.Errorf("cannot connect to Graphite at %s: %s", b.graphiteAddress, err.Error())
     }
+    return nil
 }
-func (b *GraphiteBackend) endAggregation() {
-    if b.clientGraphite != nil {
-        b.clientGraphite.Write(b.buffer.Bytes())
-        b.clientGraphite.Close()
+func (b *GraphiteBackend) endAggregation(ctx context.Context) error {
+    defer b.clientGraphite.Close()
+    if deadline, ok := ctx.Deadline(); ok {
+        b.clientGraphite.SetWriteDeadline(deadline)
+    }
+    _, err := b.clientGraphite.Write(b.buffer.Bytes())
+    if err != nil {
+        return fmt.Errorf("cannot send to Graphite at %s: %s", b.graphiteAddress, err.Error())
     }
+    return nil
 }
 
-func (b *GraphiteBackend) handleCounter(name string, count int64, count_ps float64) {
-    fmt.Fprintf(b.buffer, "stats.%s %d %d\n", name, count_ps, b.now)
-    fmt.Fprintf(b.buffer, "stats_counts.%s %d %d\n", name, count, b.now)
+func (b *GraphiteBackend) handleCounter(name string, tags []string, count float64, count_ps float64) error {
+    t := graphite_tags(tags)
+    b.printf("stats.%s%s %f %d\n", name, t, count_ps, b.now)
+    b.printf("stats_counts.%s%s %f %d\n", name, t, count, b.now)
+    return nil
 }
-func (b *GraphiteBackend) handleGauge(name string, v float64) {
-    fmt.Fprintf(b.buffer, "stats.%s %f %d\n", name, v, b.now)
+func (b *GraphiteBackend) handleGauge(name string, tags []string, gs GaugeStats) error {
+    t := graphite_tags(tags)
+    for _, s := range gs.series() {
+        b.printf("stats.%s%s %f %d\n", series_name(name, s), t, s.v, b.now)
+    }
+    return nil
 }
-func (b *GraphiteBackend) handleTiming(name string, td TimerDistribution) {
-    fmt.Fprintf(b.buffer, "stats.timers.%s.mean %f %d\n",     name, td.mean, b.now)
-    fmt.Fprintf(b.buffer, "stats.timers.%s.upper %f %d\n",    name, td.max, b.now)
-    fmt.Fprintf(b.buffer, "stats.timers.%s.upper_%d %f %d\n", name, 75, td.q_75, b.now)
-    fmt.Fprintf(b.buffer, "stats.timers.%s.upper_%d %f %d\n", name, 90, td.q_90, b.now)
-    fmt.Fprintf(b.buffer, "stats.timers.%s.upper_%d %f %d\n", name, 95, td.q_95, b.now)
-    fmt.Fprintf(b.buffer, "stats.timers.%s.lower %f %d\n",    name, td.min, b.now)
-    fmt.Fprintf(b.buffer, "stats.timers.%s.count %d %d\n",    name, td.count, b.now)
-    fmt.Fprintf(b.buffer, "stats.timers.%s.count_ps %f %d\n", name, td.count_ps, b.now)
+func (b *GraphiteBackend) handleTiming(name string, tags []string, td TimerDistribution) error {
+    t := graphite_tags(tags)
+    b.printf("stats.timers.%s.mean%s %f %d\n",     name, t, td.mean, b.now)
+    b.printf("stats.timers.%s.upper%s %f %d\n",    name, t, td.max, b.now)
+    for _, p := range td.percentiles {
+        pn := percentile_name(p.p)
+        b.printf("stats.timers.%s.upper_%s%s %f %d\n",       name, pn, t, p.v, b.now)
+        b.printf("stats.timers.%s.mean_%s%s %f %d\n",        name, pn, t, p.mean, b.now)
+        b.printf("stats.timers.%s.sum_%s%s %f %d\n",         name, pn, t, p.sum, b.now)
+        b.printf("stats.timers.%s.sum_squares_%s%s %f %d\n", name, pn, t, p.sum_squares, b.now)
+        b.printf("stats.timers.%s.count_%s%s %f %d\n",       name, pn, t, p.count, b.now)
+    }
+    b.printf("stats.timers.%s.lower%s %f %d\n",    name, t, td.min, b.now)
+    b.printf("stats.timers.%s.count%s %f %d\n",    name, t, td.count, b.now)
+    b.printf("stats.timers.%s.count_ps%s %f %d\n", name, t, td.count_ps, b.now)
+    b.printf("stats.timers.%s.sum%s %f %d\n",      name, t, td.sum, b.now)
+    b.printf("stats.timers.%s.sum_squares%s %f %d\n", name, t, td.sum_squares, b.now)
+    b.printf("stats.timers.%s.std%s %f %d\n",      name, t, td.stddev, b.now)
+    b.printf("stats.timers.%s.median%s %f %d\n",   name, t, td.median, b.now)
+    for _, bin := range td.histogram {
+        b.printf("stats.timers.%s.histogram.%s%s %f %d\n", name, bin_name(bin.upper), t, bin.count, b.now)
+    }
+    return nil
+}
+func (b *GraphiteBackend) handleSet(name string, tags []string, count int64) error {
+    t := graphite_tags(tags)
+    b.printf("stats.sets.%s.count%s %d %d\n", name, t, count, b.now)
+    return nil
+}
+
+// graphite_tags formats tags for Graphite's tagged series syntax
+// ("name;tag=value;..."). Graphite has no bare tags, so those get the
+// value "true".
+func graphite_tags(tags []string) string {
+    if len(tags) == 0 {
+        return ""
+    }
+    parts := make([]string, len(tags))
+    for i, tag := range tags {
+        name, value := split_tag(tag)
+        if value == "" {
+            value = "true"
+        }
+        parts[i] = ";" + name + "=" + value
+    }
+    return strings.Join(parts, "")
 }
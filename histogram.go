@@ -0,0 +1,103 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// HistogramConfig gives the timers whose name matches pattern (a glob,
+// e.g. "api.*.latency") histogram bins with the given upper bounds. A
+// last bin catches everything above the highest bound.
+type HistogramConfig struct {
+	pattern string
+	bounds  []float64
+}
+
+type HistogramBin struct {
+	upper float64 // +Inf for the last bin
+	count float64
+}
+
+// histogramFlags collects repeated -histogram 'pattern=10,50,200' flags.
+type histogramFlags []HistogramConfig
+
+func (h *histogramFlags) String() string {
+	parts := make([]string, len(*h))
+	for i, c := range *h {
+		bounds := make([]string, len(c.bounds))
+		for j, b := range c.bounds {
+			bounds[j] = strconv.FormatFloat(b, 'f', -1, 64)
+		}
+		parts[i] = c.pattern + "=" + strings.Join(bounds, ",")
+	}
+	return strings.Join(parts, " ")
+}
+
+func (h *histogramFlags) Set(value string) error {
+	c, err := parse_histogram(value)
+	if err != nil {
+		return err
+	}
+	*h = append(*h, c)
+	return nil
+}
+
+func (h *histogramFlags) reset() {
+	*h = nil
+}
+
+func parse_histogram(value string) (HistogramConfig, error) {
+	var c HistogramConfig
+	eq := strings.LastIndex(value, "=")
+	if eq <= 0 {
+		return c, fmt.Errorf("expected pattern=bound,bound,... in '%s'", value)
+	}
+	c.pattern = value[:eq]
+	if _, err := path.Match(c.pattern, ""); err != nil {
+		return c, fmt.Errorf("bad pattern '%s'", c.pattern)
+	}
+	for _, item := range strings.Split(value[eq+1:], ",") {
+		b, err := strconv.ParseFloat(strings.TrimSpace(item), 64)
+		if err != nil || math.IsInf(b, 0) || math.IsNaN(b) {
+			return c, fmt.Errorf("bad histogram bound '%s'", item)
+		}
+		c.bounds = append(c.bounds, b)
+	}
+	sort.Float64s(c.bounds)
+	for i := 1; i < len(c.bounds); i++ {
+		if c.bounds[i] == c.bounds[i-1] {
+			return c, fmt.Errorf("histogram bound %s given twice", strconv.FormatFloat(c.bounds[i], 'f', -1, 64))
+		}
+	}
+	return c, nil
+}
+
+var histograms histogramFlags
+
+func init() {
+	flag.Var(&histograms, "histogram", "Histogram bins for timers matching a pattern, e.g. 'api.*=10,50,200' (may be repeated, the first match wins)")
+}
+
+// histogram_bounds returns the bin bounds configured for a timer, or nil.
+func histogram_bounds(name string) []float64 {
+	for _, c := range histograms {
+		if ok, _ := path.Match(c.pattern, name); ok {
+			return c.bounds
+		}
+	}
+	return nil
+}
+
+// bin_name formats a bin for metric and data source names: "bin_10",
+// "bin_0_5", "bin_inf".
+func bin_name(upper float64) string {
+	if math.IsInf(upper, 1) {
+		return "bin_inf"
+	}
+	return "bin_" + strings.Replace(strings.Replace(strconv.FormatFloat(upper, 'f', -1, 64), ".", "_", -1), "-", "m", -1)
+}
@@ -1,227 +1,600 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"errors"
 	"flag"
+	"fmt"
 	"log"
+	"math"
+	"runtime"
 	"runtime/pprof"
 	"os"
 	"net"
-	"regexp"
+	"os/signal"
 	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
 const (
 	TCP = "tcp"
 	UDP = "udp"
+	UNIX = "unix"
+	UNIXGRAM = "unixgram"
+
+	BLOCK = "block"
+	DROP_NEWEST = "drop-newest"
+	DROP_OLDEST = "drop-oldest"
 )
 
 
 type Packet struct {
 	Bucket   string
-	Value    string
+	Value    float64
+	Member   string // value of a set
 	Modifier string
-	Sampling float32
+	Relative bool   // gauge delta ("+N" or "-N")
+	Sampling float64
+	Tags     []string
 }
 
 var (
 	serviceAddress   = flag.String("address", ":8125", "UDP service address")
 	fwdToAddress     = flag.String("fwd-to", "", "Forward UDP packets to this address")
 	graphiteAddress  = flag.String("graphite", "", "Graphite service address (example: 'localhost:2003')")
+	graphitePrefix   = flag.String("graphite-prefix", "", "Prefix of every metric sent to -graphite")
 	flushInterval    = flag.Int64("flush-interval", 10, "Flush interval")
 	debug            = flag.Bool("debug", false, "Debug mode")
     cpuprofile       = flag.String("cpuprofile", "", "Write cpu profile to this file")
     logThis          = flag.String("log-this", "", "Log these metrics to stdout on every flush")
+	percentiles      = flag.String("percentiles", "50,75,90,95", "Comma-separated timer percentiles to compute")
+	timerAccuracy    = flag.Float64("timer-accuracy", 0.01, "Relative error of timer percentiles")
+	tcpAddress       = flag.String("tcp-address", "", "TCP service address for newline-delimited statsd traffic (disabled if empty)")
+	tcpMaxLine       = flag.Int("tcp-max-line", 8192, "Close TCP and unix stream connections sending a line longer than this; shorter lines over -max-line-length are rejected as oversize")
+	tcpIdleTimeout   = flag.Int64("tcp-idle-timeout", 300, "Close TCP and unix stream connections idle for this many seconds (0 to never close)")
+	unixgramSocket   = flag.String("unixgram-socket", "", "Unix datagram socket path (disabled if empty)")
+	unixSocket       = flag.String("unix-socket", "", "Unix stream socket path for newline-delimited statsd traffic (disabled if empty)")
+	unixSocketMode   = flag.String("unix-socket-mode", "0666", "File permissions of the unix sockets")
+	maxLineLength    = flag.Int("max-line-length", 4096, "Reject statsd lines longer than this")
+	logBadLines      = flag.Int("log-bad-lines", 0, "Log at most this many rejected lines per second (0 to disable)")
+	udpReadSize      = flag.Int("udp-read-size", 8192, "Maximum size of a UDP or unix datagram; longer ones are truncated")
+	udpRcvBuf        = flag.Int("udp-rcvbuf", 0, "Socket receive buffer size (SO_RCVBUF) for UDP and unix datagrams (0 for the OS default)")
+	udpReaders       = flag.Int("udp-readers", 1, "Number of UDP sockets (bound with SO_REUSEPORT if more than one) and reader goroutines")
+	workers          = flag.Int("workers", runtime.NumCPU(), "Number of goroutines parsing datagrams")
+	workQueue        = flag.Int("work-queue", 1000, "Number of datagrams waiting to be parsed before readers block")
+	aggregators      = flag.Int("aggregators", 1, "Number of aggregator goroutines, each owning a share of the metrics")
+	dropPolicy       = flag.String("drop-policy", BLOCK, "What to do with a parsed packet when the aggregation queue is full: block, drop-newest or drop-oldest")
+	flushTimeout     = flag.Int64("flush-timeout", 0, "Seconds each backend may take to store a flush (0 for the flush interval)")
+	expireCounters   = flag.Int("expire-counters", -1, "Stop sending a counter after this many flushes without updates (-1 to never expire, 0 to send nothing when idle)")
+	expireGauges     = flag.Int("expire-gauges", -1, "Stop sending a gauge after this many flushes without updates (-1 to never expire, 0 to send nothing when idle)")
+	expireTimers     = flag.Int("expire-timers", -1, "Stop sending a timer after this many flushes without updates (-1 to never expire, 0 to send nothing when idle)")
+	expireSets       = flag.Int("expire-sets", -1, "Stop sending a set after this many flushes without updates (-1 to never expire, 0 to send nothing when idle)")
 )
 
 type TimerDistribution struct {
-    count int
+    count float64 // weighted by 1/sampling rate
     count_ps float64
     mean float64
     min float64
-    q_50 float64
-    q_75 float64
-    q_90 float64
-    q_95 float64
+    percentiles []Percentile
     max float64
+    median float64
+    sum float64
+    sum_squares float64
+    stddev float64
+    histogram []HistogramBin // nil unless configured by -histogram
+}
+
+type Percentile struct {
+    p float64 // 0 < p <= 100
+    v float64
+    // statistics of the samples below the percentile
+    count float64
+    mean float64
+    sum float64
+    sum_squares float64
 }
 
+// StatsdBackend receives every flush: beginAggregation, the handle*
+// calls in any order and endAggregation, all from one goroutine. A
+// handle* error is about a single metric and does not stop the flush.
+// The context expires after -flush-timeout.
 type StatsdBackend interface {
-    beginAggregation()
-    handleCounter(name string, count int64, count_ps float64)
-    handleGauge(name string, v float64)
-    handleTiming(name string, params TimerDistribution)
-    endAggregation()
+    beginAggregation(ctx context.Context, ts time.Time) error
+    handleCounter(name string, tags []string, count float64, count_ps float64) error
+    handleGauge(name string, tags []string, params GaugeStats) error
+    handleTiming(name string, tags []string, params TimerDistribution) error
+    handleSet(name string, tags []string, count int64) error
+    endAggregation(ctx context.Context) error
 }
 
 var (
-	In       = make(chan Packet, 10000)
-	counters = make(map[string]int)
-	timers   = make(map[string][]float64)
-	gauges   = make(map[string]int)
+	// Packets thrown away by -drop-policy, reported at every flush.
+	droppedPackets int64
+
+	// Internal counters bumped for every datagram or line, by name. As
+	// packets they would all hash to one shard and funnel every worker
+	// through it, so they are atomics folded in at every flush.
+	hotCounters = make(map[string]*int64)
 )
 
+func init() {
+	for _, name := range []string{
+		"packets_received", "datagrams_truncated", "bad_lines_seen",
+		"bad_lines.bad_value", "bad_lines.unknown_type", "bad_lines.bad_sample_rate",
+		"bad_lines.oversize", "bad_lines.malformed",
+	} {
+		hotCounters[name] = new(int64)
+	}
+}
+
 
-func buildBackends() []StatsdBackend {
-    var backends []StatsdBackend
-    if *graphiteAddress != "" {
-        backends = append(backends, NewGraphiteBackend(*graphiteAddress))
+// buildBackends makes the backends of configs. Those declared exactly as
+// in old are kept, with their state and any flush still running.
+func buildBackends(configs []BackendConfig, old []*Backend) ([]*Backend, error) {
+    var backends []*Backend
+    for _, c := range configs {
+        if bk := find_backend(old, c); bk != nil {
+            backends = append(backends, bk)
+            continue
+        }
+        b, err := backendTypes[c.kind].build(c)
+        if err != nil {
+            return nil, fmt.Errorf("backend %s: %s", c.name, err.Error())
+        }
+        backends = append(backends, &Backend{name: c.name, config: c, StatsdBackend: b})
     }
-	if *logThis != "" {
-        backends = append(backends, NewStdoutBackend(*logThis))
-	}
-	backends = append(backends, NewRrdBackend())
-    return backends
+    return backends, nil
 }
 
 func monitor() {
-    backends := buildBackends()
-	t := time.NewTicker(time.Duration(*flushInterval) * time.Second)
+    backends, err := buildBackends(backend_configs(), nil)
+    if err != nil {
+        log.Fatal(err)
+    }
+	// Statistics about statsd-monitor itself, merged into every flush.
+	internal := NewMetrics()
+	lastSwap := time.Now()
+	var lastFlush time.Time
+	takeSnapshot := func(ts time.Time) *Metrics {
+		if n := atomic.SwapInt64(&droppedPackets, 0); n > 0 {
+			internal.addInternalCounter("packets_dropped", float64(n))
+		}
+		for name, c := range hotCounters {
+			if n := atomic.SwapInt64(c, 0); n > 0 {
+				internal.addInternalCounter(name, float64(n))
+			}
+		}
+		now := time.Now()
+		snapshot := swapShards()
+		snapshot.merge(internal)
+		snapshot.add(&Packet{Bucket: "statsd-monitor.metrics_live", Value: float64(snapshot.size()), Modifier: "g", Sampling: 1})
+		snapshot.interval = now.Sub(lastSwap).Seconds()
+		snapshot.time = ts
+		internal = internal.carryOver()
+		lastSwap = now
+		lastFlush = ts
+		return snapshot
+	}
+	flushing := false
+	type flushReport struct {
+		duration time.Duration
+		results  []FlushResult
+	}
+	flushDone := make(chan flushReport)
+	// Flushes happen at multiples of -flush-interval since the epoch so
+	// that the series of several instances line up.
+	next := next_flush(time.Now(), time.Time{}, *flushInterval)
+	t := time.NewTimer(time.Until(next))
 	for {
 		select {
 		case <-t.C:
-			submit(backends)
-		case s := <-In:
-			if s.Modifier == "ms" {
-				_, ok := timers[s.Bucket]
-				if !ok {
-					var t []float64
-					timers[s.Bucket] = t
-				}
-				floatValue, _ := strconv.ParseFloat(s.Value, 32)
-				if s.Sampling < 1.0 {
-					for i := 0; float32(i) < (1 / s.Sampling); i++ {
-						timers[s.Bucket] = append(timers[s.Bucket], floatValue)
-					}
+			ts := next
+			next = next_flush(time.Now(), ts, *flushInterval)
+			t.Reset(time.Until(next))
+			if flushing {
+				// Shards keep aggregating into the same maps; the next
+				// flush covers both intervals.
+				log.Printf("Previous flush is still running, skipping this one")
+				internal.addInternalCounter("flushes_skipped", 1)
+				continue
+			}
+			snapshot := takeSnapshot(ts)
+			flushing = true
+			go func(backends []*Backend) {
+				start := time.Now()
+				results := submit(backends, snapshot)
+				flushDone <- flushReport{time.Since(start), results}
+			}(backends)
+		case r := <-flushDone:
+			flushing = false
+			internal.addInternalTiming("flush_duration", r.duration)
+			for _, result := range r.results {
+				internal.addInternalTiming("backends." + result.name + ".flush_duration", result.duration)
+				if result.err != nil {
+					log.Printf("Backend %s failed: %s", result.name, result.err.Error())
+					internal.addInternalCounter("backends." + result.name + ".failures", 1)
 				} else {
-					timers[s.Bucket] = append(timers[s.Bucket], floatValue)
+					internal.addInternalCounter("backends." + result.name + ".successes", 1)
 				}
-			} else if s.Modifier == "g" {
-                floatValue, _ := strconv.ParseFloat(s.Value, 32)
-				intValue := int(floatValue)
-				gauges[s.Bucket] = intValue
-			} else {
-				_, ok := counters[s.Bucket]
-				if !ok {
-					counters[s.Bucket] = 0
+			}
+		case <-reloads:
+			if b, ok := reload_config(backends); ok {
+				backends = b
+			}
+		case <-stopping:
+			t.Stop()
+			if flushing {
+				<-flushDone
+			}
+			stopReceiving()
+			// The last flush covers what arrived since the previous one.
+			ts := time.Unix(time.Now().Unix(), 0)
+			if !ts.After(lastFlush) {
+				ts = lastFlush.Add(time.Second)
+			}
+			log.Printf("Flushing before exit")
+			for _, result := range submit(backends, takeSnapshot(ts)) {
+				if result.err != nil {
+					log.Printf("Backend %s failed: %s", result.name, result.err.Error())
 				}
-				floatValue, _ := strconv.ParseFloat(s.Value, 32)
-				counters[s.Bucket] += int(float32(floatValue) * (1 / s.Sampling))
 			}
+			return
 		}
 	}
 }
 
-func submit(backends []StatsdBackend) {
-    for _, bk := range backends {
-        bk.beginAggregation()
-    }
+// next_flush returns the first multiple of interval seconds since the
+// epoch after now, or one interval after the last flush if the wall
+// clock went back before it.
+func next_flush(now time.Time, last time.Time, interval int64) time.Time {
+	next := time.Unix((now.Unix() / interval + 1) * interval, 0)
+	if !next.After(last) {
+		next = last.Add(time.Duration(interval) * time.Second)
+	}
+	return next
+}
 
-	numStats := 0
-	for s, c := range counters {
-		value := float64(c) / float64(*flushInterval)
-		counters[s] = 0
-        for _, bk := range backends {
-            bk.handleCounter(s, int64(c), value)
-        }
-		numStats++
+var timerPercentiles []float64
+
+func parse_percentiles(s string) ([]float64, error) {
+	var result []float64
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		p, err := strconv.ParseFloat(item, 64)
+		if err != nil || p <= 0 || p > 100 {
+			return nil, fmt.Errorf("bad percentile '%s'", item)
+		}
+		result = append(result, p)
 	}
-	for i, g := range gauges {
-        for _, bk := range backends {
-            bk.handleGauge(i, float64(g))
-        }
-		numStats++
-	}
-	for u, t := range timers {
-        var td TimerDistribution;
-		if len(t) > 0 {
-            float_len := float64(len(t))
-			sort.Float64s(t)
-			td.min = float64(t[0])
-			td.max = float64(t[len(t)-1])
-			td.q_50 = float64(t[len(t)/2])
-            td.q_75 = float64(t[int(float_len*0.75)])
-            td.q_90 = float64(t[int(float_len*0.90)])
-            td.q_95 = float64(t[int(float_len*0.95)])
-			td.count = len(t)
-			td.count_ps = float64(len(t)) / float64(*flushInterval)
-
-            sum := float64(0)
-            for i := 0; i < len(t); i++ {
-                sum += t[i]
-            }
-            td.mean = float64(sum) / float64(td.count)
+	sort.Float64s(result)
+	for i := 1; i < len(result); i++ {
+		if result[i] == result[i-1] {
+			return nil, fmt.Errorf("percentile %s given twice", strconv.FormatFloat(result[i], 'f', -1, 64))
+		}
+	}
+	return result, nil
+}
 
-			var z []float64
-			timers[u] = z
-		} else {
-			td.min = 0
-			td.max = 0
-			td.q_50 = 0
-			td.mean = 0
-            td.q_75 = 0
-            td.q_90 = 0
-            td.q_95 = 0
-			td.count = 0
-			td.count_ps = 0
-		}
-        for _, bk := range backends {
-            bk.handleTiming(u, td)
-        }
-		numStats++
+// percentile_name formats a percentile for metric and data source
+// names: 99.9 becomes "99_9".
+func percentile_name(p float64) string {
+	return strings.Replace(strconv.FormatFloat(p, 'f', -1, 64), ".", "_", -1)
+}
+
+func timer_distribution(name string, t *Sketch, interval float64) TimerDistribution {
+	var td TimerDistribution
+	td.percentiles = make([]Percentile, len(timerPercentiles))
+	bounds := histogram_bounds(name)
+	if t == nil || t.count == 0 {
+		for i, p := range timerPercentiles {
+			td.percentiles[i] = Percentile{p: p}
+		}
+		if bounds != nil {
+			td.histogram = NewSketch(*timerAccuracy).histogram(bounds)
+		}
+		return td
 	}
-    for _, bk := range backends {
-        bk.endAggregation()
-    }
+	if bounds != nil {
+		td.histogram = t.histogram(bounds)
+	}
+
+	qs := make([]float64, len(timerPercentiles))
+	for i, p := range timerPercentiles {
+		qs[i] = p / 100
+	}
+	for i, v := range t.quantiles(qs) {
+		pct := Percentile{p: timerPercentiles[i], v: v}
+		pct.count, pct.sum, pct.sum_squares = t.lower(qs[i])
+		if pct.count > 0 {
+			pct.mean = pct.sum / pct.count
+		}
+		td.percentiles[i] = pct
+	}
+	td.min = t.min
+	td.max = t.max
+	td.median = t.quantiles([]float64{0.5})[0]
+	td.count = t.count
+	td.count_ps = t.count / interval
+	td.mean = t.sum / t.count
+	td.sum = t.sum
+	td.sum_squares = t.sumSquares
+	td.stddev = math.Sqrt(math.Max(0, t.sumSquares / t.count - td.mean * td.mean))
+	return td
+}
+
+// FlushResult is how one backend did with a flush.
+type FlushResult struct {
+	name     string
+	duration time.Duration
+	err      error
 }
 
-var sanitizeRegexp = regexp.MustCompile("[^a-zA-Z0-9\\-_\\.:\\|@]")
-var packetRegexp = regexp.MustCompile("([a-zA-Z0-9_\\.\\-]+):(\\-?[0-9\\.]+)\\|(c|g|ms)(\\|@([0-9\\.]+))?")
-
-func handleMessage(conn *net.UDPConn, remaddr net.Addr, buf *bytes.Buffer) {
-	var packet Packet
-	var value string
-	/*s := sanitizeRegexp.ReplaceAllString(buf.String(), "")*/
-    s := buf.String()
-	for _, item := range packetRegexp.FindAllStringSubmatch(s, -1) {
-		value = item[2]
-		if item[3] == "ms" {
-			_, err := strconv.ParseFloat(item[2], 32)
-			if err != nil {
-				value = "0"
+// submit sends a snapshot to all backends at once, each from its own
+// goroutine, and waits until they are done or -flush-timeout expires.
+// A backend that has not finished by then is reported as timed out and
+// skipped by later flushes until its goroutine returns.
+func submit(backends []*Backend, m *Metrics) []FlushResult {
+	timeout := time.Duration(*flushTimeout) * time.Second
+	if timeout <= 0 {
+		timeout = time.Duration(*flushInterval) * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// Distributions are computed once and shared by the backends.
+	gauges := make(map[string]GaugeStats, len(m.gauges))
+	for key, g := range m.gauges {
+		name, _ := split_metric_key(key)
+		gauges[key] = gauge_stats(name, g)
+	}
+	timings := make(map[string]TimerDistribution, len(m.timers))
+	for key, t := range m.timers {
+		name, _ := split_metric_key(key)
+		timings[key] = timer_distribution(name, t, m.interval)
+	}
+
+	type indexedResult struct {
+		i      int
+		result FlushResult
+	}
+	results := make([]FlushResult, len(backends))
+	// Buffered so that a backend finishing after the timeout never blocks.
+	finished := make(chan indexedResult, len(backends))
+	pending := make(map[int]bool)
+	for i, bk := range backends {
+		if !atomic.CompareAndSwapInt32(&bk.busy, 0, 1) {
+			results[i] = FlushResult{bk.name, 0, fmt.Errorf("skipped, still busy with an earlier flush")}
+			continue
+		}
+		pending[i] = true
+		go func(i int, bk *Backend) {
+			start := time.Now()
+			err := flushBackend(ctx, bk, m, gauges, timings)
+			atomic.StoreInt32(&bk.busy, 0)
+			finished <- indexedResult{i, FlushResult{bk.name, time.Since(start), err}}
+		}(i, bk)
+	}
+	for len(pending) > 0 {
+		select {
+		case r := <-finished:
+			results[r.i] = r.result
+			delete(pending, r.i)
+		case <-ctx.Done():
+			for i := range pending {
+				results[i] = FlushResult{backends[i].name, timeout, fmt.Errorf("timed out after %s", timeout)}
 			}
+			return results
 		}
+	}
+	return results
+}
 
-		sampleRate, err := strconv.ParseFloat(item[5], 32)
+// flushBackend sends a snapshot to one backend. It stops early when ctx
+// expires, carries on past metrics the backend fails to store and turns
+// a panic of the backend into an error.
+func flushBackend(ctx context.Context, bk *Backend, m *Metrics, gauges map[string]GaugeStats, timings map[string]TimerDistribution) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	if err := bk.beginAggregation(ctx, m.time); err != nil {
+		return err
+	}
+
+	failed := 0
+	var first error
+	// check counts a failed write and tells whether to go on.
+	check := func(err error) bool {
 		if err != nil {
-			sampleRate = 1
+			if failed == 0 {
+				first = err
+			}
+			failed++
+		}
+		return ctx.Err() == nil
+	}
+	sendAll := func() bool {
+		for key, c := range m.counters {
+			name, tags := split_metric_key(key)
+			if !check(bk.handleCounter(name, tags, c, c / m.interval)) {
+				return false
+			}
+		}
+		for key, gs := range gauges {
+			name, tags := split_metric_key(key)
+			if !check(bk.handleGauge(name, tags, gs)) {
+				return false
+			}
+		}
+		for key, td := range timings {
+			name, tags := split_metric_key(key)
+			if !check(bk.handleTiming(name, tags, td)) {
+				return false
+			}
+		}
+		for key, set := range m.sets {
+			name, tags := split_metric_key(key)
+			if !check(bk.handleSet(name, tags, int64(len(set)))) {
+				return false
+			}
 		}
+		return true
+	}
+	complete := sendAll()
+	check(bk.endAggregation(ctx))
+
+	if !complete {
+		return fmt.Errorf("flush interrupted: %s", ctx.Err().Error())
+	}
+	if failed > 1 {
+		return fmt.Errorf("%d writes failed, the first with: %s", failed, first.Error())
+	}
+	return first
+}
+
+var badLinesLog = NewRateLimiter()
+
+// rejectLine logs a line that failed to parse, at most -log-bad-lines
+// times a second, and counts it.
+func rejectLine(from net.Addr, line []byte, err error) {
+	if *logBadLines > 0 && badLinesLog.allow(*logBadLines) {
+		log.Printf("Rejected line from %s (%s): %q", addr_string(from), err.Error(), line)
+	} else if *debug {
+		log.Printf("Rejected line (%s): %s", err.Error(), string(line))
+	}
+	countRejected(err)
+}
+
+// countRejected counts a rejected line in the total and in a per-reason
+// counter.
+func countRejected(err error) {
+	internalCounter("bad_lines_seen")
+	internalCounter("bad_lines." + reject_reason(err))
+}
 
-		packet.Bucket = item[1]
-		packet.Value = value
-		packet.Modifier = item[3]
-		packet.Sampling = float32(sampleRate)
+// enqueue hands a packet to its aggregator shard, applying -drop-policy
+// when the shard's queue is full.
+func enqueue(p Packet) {
+	in := shardFor(&p).in
+	switch *dropPolicy {
+	case DROP_NEWEST:
+		select {
+		case in <- p:
+		default:
+			atomic.AddInt64(&droppedPackets, 1)
+		}
+	case DROP_OLDEST:
+		for {
+			select {
+			case in <- p:
+				return
+			default:
+			}
+			select {
+			case <-in:
+				atomic.AddInt64(&droppedPackets, 1)
+			default:
+			}
+		}
+	default:
+		in <- p
+	}
+}
 
+// internalCounter counts one event in hotCounters.
+func internalCounter(name string) {
+	atomic.AddInt64(hotCounters[name], 1)
+}
+
+func internalGauge(name string, v float64) {
+	enqueue(Packet{Bucket: "statsd-monitor." + name, Value: v, Modifier: "g", Sampling: 1})
+}
+
+func handleMessage(buf []byte, from net.Addr) {
+	parser := parserPool.Get().(*Parser)
+	parser.parseMessage(buf, func(packet *Packet) {
+		if is_dropped(packet.Bucket) {
+			return
+		}
 		if *debug {
-			log.Printf("Packet: bucket = %s, value = %s, modifier = %s, sampling = %f\n", packet.Bucket, packet.Value, packet.Modifier, packet.Sampling)
+			log.Printf("Packet: bucket = %s, value = %f, member = %s, modifier = %s, sampling = %f, tags = %v\n", packet.Bucket, packet.Value, packet.Member, packet.Modifier, packet.Sampling, packet.Tags)
 		}
+		enqueue(*packet)
+	}, func(line []byte, err error) {
+		rejectLine(from, line, err)
+	})
+	parserPool.Put(parser)
+
+	internalCounter("packets_received")
+}
+
+type Datagram struct {
+	bufp *[]byte
+	n    int
+	from net.Addr
+}
 
-		In <- packet
+// Datagrams read from UDP and unix sockets wait here for a parse worker.
+var datagrams chan Datagram
+
+var parseWorkers sync.WaitGroup
+
+func parseWorker() {
+	defer parseWorkers.Done()
+	for d := range datagrams {
+		handleDatagram(d.bufp, d.n, d.from)
 	}
+}
 
-    //packet.Bucket = "statsd.packets_received"
-    //packet.Value = "1"
-    //packet.Modifier = "c"
-    //packet.Sampling = 1
-    //In <- packet
+// Datagram buffers have one spare byte so that a datagram that did not
+// fit into -udp-read-size can be told apart from one that fit exactly.
+var datagramBuffers = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, *udpReadSize+1)
+		return &b
+	},
+}
 
-    packet.Bucket = "statsd-monitor.packets_received"
-    packet.Value = "1"
-    packet.Modifier = "c"
-    packet.Sampling = 1
-    In <- packet
+// handleDatagram parses the first n bytes of a pooled buffer and returns
+// the buffer to the pool. A truncated datagram loses its last, partial
+// line.
+func handleDatagram(bufp *[]byte, n int, from net.Addr) {
+	message := (*bufp)[0:n]
+	if n > *udpReadSize {
+		internalCounter("datagrams_truncated")
+		message = message[0:*udpReadSize]
+		if i := bytes.LastIndexByte(message, '\n'); i >= 0 {
+			message = message[0:i]
+		} else {
+			message = nil
+		}
+		if *debug {
+			log.Printf("Truncated datagram from %s", addr_string(from))
+		}
+	}
+	handleMessage(message, from)
+	datagramBuffers.Put(bufp)
+}
+
+func setReadBuffer(conn interface{ SetReadBuffer(int) error }) {
+	if *udpRcvBuf <= 0 {
+		return
+	}
+	if err := conn.SetReadBuffer(*udpRcvBuf); err != nil {
+		log.Printf("Cannot set receive buffer size to %d: %s", *udpRcvBuf, err.Error())
+	}
 }
 
 func udpListener() {
@@ -238,47 +611,400 @@ func udpListener() {
             log.Fatalf("Cannot connect to '%s' via UDP (whatever what means in Go)", *fwdToAddress)
         }
     }
-	address, _ := net.ResolveUDPAddr(UDP, *serviceAddress)
-	listener, err := net.ListenUDP(UDP, address)
-	defer listener.Close()
-	if err != nil {
-		log.Fatalf("ListenAndServe: %s", err.Error())
-	}
+	listeners := listenUDP(*udpReaders)
 
-    log.Printf("Listening to UDP at %s", *serviceAddress)
+    log.Printf("Listening to UDP at %s with %d reader(s)", *serviceAddress, len(listeners))
     if fwdConn != nil {
         log.Printf("Forwarding UDP traffic to %s", *fwdToAddress)
     }
 
+	go udpKernelStats(listeners[0].LocalAddr().(*net.UDPAddr).Port)
+
+	for _, listener := range listeners {
+		listener := listener
+		atShutdown(func() { listener.Close() })
+		receivers.Add(1)
+		go udpReader(listener, fwdConn)
+	}
+}
+
+// listenUDP opens n sockets on -address. Several sockets share the port
+// via SO_REUSEPORT, and the kernel balances datagrams between them.
+func listenUDP(n int) []*net.UDPConn {
+	if n <= 1 {
+		address, _ := net.ResolveUDPAddr(UDP, *serviceAddress)
+		listener, err := net.ListenUDP(UDP, address)
+		if err != nil {
+			log.Fatalf("ListenAndServe: %s", err.Error())
+		}
+		setReadBuffer(listener)
+		return []*net.UDPConn{listener}
+	}
+
+	lc := net.ListenConfig{Control: reusePortControl}
+	listeners := make([]*net.UDPConn, n)
+	for i := range listeners {
+		conn, err := lc.ListenPacket(context.Background(), UDP, *serviceAddress)
+		if err != nil {
+			log.Fatalf("ListenAndServe: %s", err.Error())
+		}
+		listeners[i] = conn.(*net.UDPConn)
+		setReadBuffer(listeners[i])
+	}
+	return listeners
+}
+
+func udpReader(listener *net.UDPConn, fwdConn *net.UDPConn) {
+	defer receivers.Done()
+	defer listener.Close()
 	for {
-		message := make([]byte, 512)
+		bufp := datagramBuffers.Get().(*[]byte)
+		message := *bufp
 		n, remaddr, error := listener.ReadFrom(message)
 		if error != nil {
+			datagramBuffers.Put(bufp)
+			if errors.Is(error, net.ErrClosed) {
+				return
+			}
 			continue
 		}
         if fwdConn != nil {
-            fwdConn.Write(message[0:n])
+            if n > *udpReadSize {
+                fwdConn.Write(message[0:*udpReadSize])
+            } else {
+                fwdConn.Write(message[0:n])
+            }
         }
-		buf := bytes.NewBuffer(message[0:n])
 		if *debug {
 			log.Println("Packet received: " + string(message[0:n]))
 		}
-		go handleMessage(listener, remaddr, buf)
+		datagrams <- Datagram{bufp, n, remaddr}
+	}
+}
+
+// udpKernelStats reports the receive queue length and the number of
+// datagrams the kernel dropped on our UDP sockets once per flush interval.
+func udpKernelStats(port int) {
+	var lastDrops int64 = -1
+	t := time.NewTicker(time.Duration(*flushInterval) * time.Second)
+	for range t.C {
+		rxQueue, drops, err := readUdpKernelStats(port)
+		if err != nil {
+			if *debug {
+				log.Printf("Cannot read UDP kernel statistics: %s", err.Error())
+			}
+			continue
+		}
+		internalGauge("udp_rx_queue", float64(rxQueue))
+		if lastDrops >= 0 && drops >= lastDrops {
+			enqueue(Packet{Bucket: "statsd-monitor.udp_kernel_drops", Value: float64(drops - lastDrops), Modifier: "c", Sampling: 1})
+		}
+		lastDrops = drops
+	}
+}
+
+func tcpListener() {
+	defer receivers.Done()
+	listener, err := net.Listen(TCP, *tcpAddress)
+	if err != nil {
+		log.Fatalf("Cannot listen to TCP at %s: %s", *tcpAddress, err.Error())
+	}
+	defer listener.Close()
+	atShutdown(func() { listener.Close() })
+
+	log.Printf("Listening to TCP at %s", *tcpAddress)
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			if !errors.Is(err, net.ErrClosed) {
+				log.Printf("TCP accept failed: %s", err.Error())
+			}
+			return
+		}
+		receivers.Add(1)
+		go handleStreamConn(conn)
+	}
+}
+
+// handleStreamConn reads newline-delimited statsd lines from a stream
+// connection until the client disconnects, stays idle for too long or
+// sends a line longer than -tcp-max-line.
+func handleStreamConn(conn net.Conn) {
+	defer receivers.Done()
+	defer conn.Close()
+
+	// Shutdown closes the connection under the reader.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-stopping:
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	scanner := bufio.NewScanner(conn)
+	initialSize := 4096
+	if *tcpMaxLine < initialSize {
+		initialSize = *tcpMaxLine
+	}
+	scanner.Buffer(make([]byte, initialSize), *tcpMaxLine)
+
+	for {
+		if *tcpIdleTimeout > 0 {
+			conn.SetReadDeadline(time.Now().Add(time.Duration(*tcpIdleTimeout) * time.Second))
+		}
+		if !scanner.Scan() {
+			break
+		}
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		if *debug {
+			log.Println("Line received: " + string(line))
+		}
+		handleMessage(line, conn.RemoteAddr())
+	}
+	if err := scanner.Err(); err != nil && !errors.Is(err, net.ErrClosed) {
+		if err == bufio.ErrTooLong {
+			// The scanner keeps nothing of the line to log.
+			countRejected(errOversize)
+			err = fmt.Errorf("line longer than -tcp-max-line (%d bytes)", *tcpMaxLine)
+		}
+		log.Printf("Closing connection from %s: %s", conn.RemoteAddr(), err.Error())
+	}
+}
+
+// prepareUnixSocket removes a socket file left over from a previous run,
+// refusing to touch anything that is not a socket.
+func prepareUnixSocket(path string) {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		log.Fatalf("Cannot listen at %s: file exists and is not a socket", path)
+	}
+	os.Remove(path)
+}
+
+func chmodUnixSocket(path string) {
+	mode, err := strconv.ParseUint(*unixSocketMode, 8, 32)
+	if err != nil {
+		log.Fatalf("Bad unix socket mode '%s'", *unixSocketMode)
+	}
+	if err := os.Chmod(path, os.FileMode(mode)); err != nil {
+		log.Fatalf("Cannot chmod %s: %s", path, err.Error())
+	}
+}
+
+func unixgramListener() {
+	defer receivers.Done()
+	prepareUnixSocket(*unixgramSocket)
+	listener, err := net.ListenUnixgram(UNIXGRAM, &net.UnixAddr{Name: *unixgramSocket, Net: UNIXGRAM})
+	if err != nil {
+		log.Fatalf("Cannot listen at %s: %s", *unixgramSocket, err.Error())
+	}
+	chmodUnixSocket(*unixgramSocket)
+	atShutdown(func() {
+		listener.Close()
+		os.Remove(*unixgramSocket)
+	})
+
+	setReadBuffer(listener)
+
+	log.Printf("Listening to unix datagrams at %s", *unixgramSocket)
+
+	for {
+		bufp := datagramBuffers.Get().(*[]byte)
+		message := *bufp
+		n, remaddr, err := listener.ReadFrom(message)
+		if err != nil {
+			datagramBuffers.Put(bufp)
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		if *debug {
+			log.Println("Packet received: " + string(message[0:n]))
+		}
+		datagrams <- Datagram{bufp, n, remaddr}
+	}
+}
+
+func unixListener() {
+	defer receivers.Done()
+	prepareUnixSocket(*unixSocket)
+	listener, err := net.ListenUnix(UNIX, &net.UnixAddr{Name: *unixSocket, Net: UNIX})
+	if err != nil {
+		log.Fatalf("Cannot listen at %s: %s", *unixSocket, err.Error())
+	}
+	chmodUnixSocket(*unixSocket)
+	// Closing the listener removes the socket file.
+	atShutdown(func() { listener.Close() })
+
+	log.Printf("Listening to unix stream at %s", *unixSocket)
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			if !errors.Is(err, net.ErrClosed) {
+				log.Printf("Unix socket accept failed: %s", err.Error())
+			}
+			return
+		}
+		receivers.Add(1)
+		go handleStreamConn(conn)
 	}
 }
 
+var (
+	shutdownLock  sync.Mutex
+	shutdownHooks []func()
+
+	// Closed on SIGINT or SIGTERM.
+	stopping = make(chan struct{})
+	// Signalled on SIGHUP.
+	reloads = make(chan bool, 1)
+	// Listeners, datagram readers and stream connections.
+	receivers sync.WaitGroup
+)
+
+// atShutdown registers a function to run when the process is stopped
+// by SIGINT or SIGTERM, before the last flush.
+func atShutdown(f func()) {
+	shutdownLock.Lock()
+	defer shutdownLock.Unlock()
+	shutdownHooks = append(shutdownHooks, f)
+}
+
+func handleSignals() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	stopped := false
+	for sig := range c {
+		if sig == syscall.SIGHUP {
+			if *configFile == "" {
+				log.Printf("Got %s but there is no -config to reload", sig)
+				continue
+			}
+			select {
+			case reloads <- true:
+			default:
+			}
+			continue
+		}
+		if stopped {
+			log.Printf("Got %s again, exiting without a final flush", sig)
+			os.Exit(1)
+		}
+		log.Printf("Got %s, shutting down", sig)
+		close(stopping)
+		stopped = true
+	}
+}
+
+// stopReceiving closes every listener and connection, then waits until
+// everything already read is parsed and queued for the aggregators.
+func stopReceiving() {
+	shutdownLock.Lock()
+	for _, f := range shutdownHooks {
+		f()
+	}
+	shutdownLock.Unlock()
+	receivers.Wait()
+	close(datagrams)
+	parseWorkers.Wait()
+}
+
 func main() {
 	flag.Parse()
+	if *configFile != "" {
+		if err := apply_config(*configFile); err != nil {
+			log.Fatalf("Cannot load %s: %s", *configFile, err.Error())
+		}
+	}
+	storeFilters()
 
     if *cpuprofile != "" {
         f, err := os.Create(*cpuprofile)
         if err != nil {
             log.Fatal(err)
         }
+        defer f.Close()
         pprof.StartCPUProfile(f)
         defer pprof.StopCPUProfile()
     }
 
-	go udpListener()
+	var err error
+	timerPercentiles, err = parse_percentiles(*percentiles)
+	if err != nil {
+		log.Fatalf("Cannot parse -percentiles: %s", err.Error())
+	}
+	if *timerAccuracy <= 0 || *timerAccuracy >= 1 {
+		log.Fatalf("-timer-accuracy must be between 0 and 1")
+	}
+	if *dropPolicy != BLOCK && *dropPolicy != DROP_NEWEST && *dropPolicy != DROP_OLDEST {
+		log.Fatalf("Unknown drop policy '%s'", *dropPolicy)
+	}
+	if *flushInterval < 1 {
+		log.Fatalf("-flush-interval must be at least one second")
+	}
+	if *workers < 1 {
+		log.Fatalf("Need at least one worker")
+	}
+	if *aggregators < 1 {
+		log.Fatalf("Need at least one aggregator")
+	}
+	if *udpReadSize < 1 {
+		log.Fatalf("-udp-read-size must be at least one byte")
+	}
+	if *workQueue < 0 {
+		log.Fatalf("-work-queue cannot be negative")
+	}
+	if *tcpMaxLine < 1 {
+		log.Fatalf("-tcp-max-line must be at least one byte")
+	}
+	if *rrdStep < 1 {
+		log.Fatalf("-rrd-step must be at least one second")
+	}
+	if _, err := parse_retention(*rrdRetention, *rrdStep); err != nil {
+		log.Fatalf("Bad -rrd-retention: %s", err.Error())
+	}
+
+	go handleSignals()
+
+	startShards(*aggregators)
+
+	datagrams = make(chan Datagram, *workQueue)
+	for i := 0; i < *workers; i++ {
+		parseWorkers.Add(1)
+		go parseWorker()
+	}
+
+	udpListener()
+	if *tcpAddress != "" {
+		receivers.Add(1)
+		go tcpListener()
+	}
+	if *unixgramSocket != "" {
+		receivers.Add(1)
+		go unixgramListener()
+	}
+	if *unixSocket != "" {
+		receivers.Add(1)
+		go unixListener()
+	}
 	monitor()
+	log.Printf("Stopped")
 }
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestNextFlush(t *testing.T) {
+	for _, c := range []struct {
+		now, last int64
+		want      int64
+	}{
+		{1000, 0, 1010},   // on a boundary
+		{1001, 0, 1010},   // just after one
+		{1009, 990, 1010}, // just before one
+		{985, 1000, 1010}, // the clock went back before the last flush
+		{1000, 1000, 1010},
+	} {
+		got := next_flush(time.Unix(c.now, 0), time.Unix(c.last, 0), 10)
+		if got.Unix() != c.want {
+			t.Errorf("next_flush(%d, %d): got %d, want %d", c.now, c.last, got.Unix(), c.want)
+		}
+	}
+}
+
+func TestEnqueueDropPolicies(t *testing.T) {
+	defer func(old []*Shard, policy string) { shards, *dropPolicy = old, policy }(shards, *dropPolicy)
+	for _, c := range []struct {
+		policy string
+		want   []float64
+	}{
+		{DROP_NEWEST, []float64{1, 2, 3}},
+		{DROP_OLDEST, []float64{3, 4, 5}},
+	} {
+		*dropPolicy = c.policy
+		shards = []*Shard{{in: make(chan Packet, 3)}}
+		atomic.StoreInt64(&droppedPackets, 0)
+		for i := 1; i <= 5; i++ {
+			enqueue(Packet{Bucket: "c", Value: float64(i), Modifier: "c", Sampling: 1})
+		}
+		var got []float64
+		for len(shards[0].in) > 0 {
+			got = append(got, (<-shards[0].in).Value)
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: got %v, want %v", c.policy, got, c.want)
+		}
+		if n := atomic.LoadInt64(&droppedPackets); n != 2 {
+			t.Errorf("%s: got %d dropped, want 2", c.policy, n)
+		}
+	}
+
+	// Blocking keeps every packet and waits for room.
+	*dropPolicy = BLOCK
+	shards = []*Shard{{in: make(chan Packet, 3)}}
+	atomic.StoreInt64(&droppedPackets, 0)
+	for i := 1; i <= 3; i++ {
+		enqueue(Packet{Bucket: "c", Value: float64(i), Modifier: "c", Sampling: 1})
+	}
+	done := make(chan bool)
+	go func() {
+		enqueue(Packet{Bucket: "c", Value: 4, Modifier: "c", Sampling: 1})
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatalf("%s: enqueue did not wait for room", BLOCK)
+	case <-time.After(50 * time.Millisecond):
+	}
+	<-shards[0].in
+	<-done
+	if n := atomic.LoadInt64(&droppedPackets); n != 0 || len(shards[0].in) != 3 {
+		t.Errorf("%s: got %d dropped and %d queued, want 0 and 3", BLOCK, n, len(shards[0].in))
+	}
+}
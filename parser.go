@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+	"sync"
+)
+
+var (
+	errBadLine       = errors.New("malformed line")
+	errBadValue      = errors.New("bad value")
+	errUnknownType   = errors.New("unknown metric type")
+	errBadSampleRate = errors.New("bad sample rate")
+	errOversize      = errors.New("line too long")
+)
+
+// reject_reason names the statsd-monitor.bad_lines.* counter for a
+// parse error.
+func reject_reason(err error) string {
+	switch err {
+	case errBadValue:
+		return "bad_value"
+	case errUnknownType:
+		return "unknown_type"
+	case errBadSampleRate:
+		return "bad_sample_rate"
+	case errOversize:
+		return "oversize"
+	}
+	return "malformed"
+}
+
+// Interned names are dropped all at once when a cache grows past this
+// size, so a client spraying unique bucket names cannot grow it forever.
+const PARSER_CACHE_SIZE = 10000
+
+// Parser turns statsd lines into Packets without going through regexps.
+// It interns bucket names and tag lists, so parsing a known metric does
+// not allocate. A Parser is not safe for concurrent use; take one from
+// parserPool instead.
+type Parser struct {
+	names  map[string]string
+	tags   map[string][]string
+	packet Packet
+}
+
+func NewParser() *Parser {
+	var p Parser
+	p.names = make(map[string]string)
+	p.tags = make(map[string][]string)
+	return &p
+}
+
+var parserPool = sync.Pool{
+	New: func() interface{} { return NewParser() },
+}
+
+// parseMessage calls emit for every valid newline-separated line in buf
+// and reject for every invalid one. The Packet passed to emit is reused
+// between calls.
+func (p *Parser) parseMessage(buf []byte, emit func(*Packet), reject func(line []byte, err error)) {
+	for len(buf) > 0 {
+		var line []byte
+		i := bytes.IndexByte(buf, '\n')
+		if i < 0 {
+			line, buf = buf, nil
+		} else {
+			line, buf = buf[:i], buf[i+1:]
+		}
+		if len(line) > 0 && line[len(line)-1] == '\r' {
+			line = line[:len(line)-1]
+		}
+		if len(line) == 0 {
+			continue
+		}
+		if len(line) > *maxLineLength {
+			reject(line, errOversize)
+			continue
+		}
+		if err := p.parseLine(line, &p.packet); err != nil {
+			reject(line, err)
+			continue
+		}
+		emit(&p.packet)
+	}
+}
+
+// parseLine parses a single "bucket:value|type[|@rate][|#tags]" line.
+func (p *Parser) parseLine(line []byte, packet *Packet) error {
+	colon := bytes.IndexByte(line, ':')
+	if colon <= 0 || !is_valid_name(line[:colon]) {
+		return errBadLine
+	}
+	name := line[:colon]
+	rest := line[colon+1:]
+
+	bar := bytes.IndexByte(rest, '|')
+	if bar <= 0 {
+		return errBadLine
+	}
+	value := rest[:bar]
+	rest = rest[bar+1:]
+
+	var kind []byte
+	bar = bytes.IndexByte(rest, '|')
+	if bar < 0 {
+		kind, rest = rest, nil
+	} else {
+		kind, rest = rest[:bar], rest[bar:]
+	}
+
+	switch string(kind) {
+	case "c":
+		packet.Modifier = "c"
+	case "g":
+		packet.Modifier = "g"
+	case "ms":
+		packet.Modifier = "ms"
+	case "s":
+		packet.Modifier = "s"
+	default:
+		return errUnknownType
+	}
+
+	packet.Sampling = 1
+	packet.Tags = nil
+	packet.Member = ""
+	packet.Relative = false
+	packet.Value = 0
+
+	seenRate, seenTags := false, false
+	for len(rest) > 0 {
+		// rest is "|section|section...", with a leading bar
+		rest = rest[1:]
+		var section []byte
+		bar = bytes.IndexByte(rest, '|')
+		if bar < 0 {
+			section, rest = rest, nil
+		} else {
+			section, rest = rest[:bar], rest[bar:]
+		}
+		if len(section) < 2 {
+			return errBadLine
+		}
+		switch section[0] {
+		case '@':
+			if seenRate {
+				return errBadLine
+			}
+			seenRate = true
+			rate, ok := parse_number(section[1:])
+			if !ok || rate <= 0 || rate > 1 {
+				return errBadSampleRate
+			}
+			packet.Sampling = rate
+		case '#':
+			if seenTags {
+				return errBadLine
+			}
+			seenTags = true
+			tags, ok := p.internTags(section[1:])
+			if !ok {
+				return errBadLine
+			}
+			packet.Tags = tags
+		default:
+			return errBadLine
+		}
+	}
+
+	if packet.Modifier == "s" {
+		packet.Member = string(value)
+	} else {
+		v, ok := parse_number(value)
+		if !ok {
+			return errBadValue
+		}
+		packet.Value = v
+		packet.Relative = packet.Modifier == "g" && (value[0] == '+' || value[0] == '-')
+	}
+
+	packet.Bucket = p.internName(name)
+	return nil
+}
+
+func (p *Parser) internName(b []byte) string {
+	if s, ok := p.names[string(b)]; ok {
+		return s
+	}
+	if len(p.names) >= PARSER_CACHE_SIZE {
+		p.names = make(map[string]string)
+	}
+	s := string(b)
+	p.names[s] = s
+	return s
+}
+
+func (p *Parser) internTags(b []byte) ([]string, bool) {
+	if tags, ok := p.tags[string(b)]; ok {
+		return tags, true
+	}
+	for _, c := range b {
+		if !is_name_char(c) && c != ':' && c != ',' {
+			return nil, false
+		}
+	}
+	if len(p.tags) >= PARSER_CACHE_SIZE {
+		p.tags = make(map[string][]string)
+	}
+	s := string(b)
+	tags := parse_tags(s)
+	p.tags[s] = tags
+	return tags, true
+}
+
+func is_name_char(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+		c == '_' || c == '.' || c == '-'
+}
+
+func is_valid_name(b []byte) bool {
+	for _, c := range b {
+		if !is_name_char(c) {
+			return false
+		}
+	}
+	return true
+}
+
+// parse_number accepts plain decimal numbers with an optional sign and
+// exponent; unlike strconv.ParseFloat alone it rejects "NaN", "Inf",
+// hex floats and underscores.
+func parse_number(b []byte) (float64, bool) {
+	if len(b) == 0 {
+		return 0, false
+	}
+	digits := false
+	for i, c := range b {
+		switch {
+		case c >= '0' && c <= '9':
+			digits = true
+		case c == '.' || c == 'e' || c == 'E':
+		case (c == '+' || c == '-') && (i == 0 || b[i-1] == 'e' || b[i-1] == 'E'):
+		default:
+			return 0, false
+		}
+	}
+	if !digits {
+		return 0, false
+	}
+	v, err := strconv.ParseFloat(string(b), 64)
+	if err != nil {
+		return 0, false
+	}
+	return v, true
+}
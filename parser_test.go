@@ -0,0 +1,190 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestParseLine(t *testing.T) {
+	valid := []struct {
+		line   string
+		packet Packet
+	}{
+		{"foo:1|c", Packet{Bucket: "foo", Value: 1, Modifier: "c", Sampling: 1}},
+		{"foo.bar-baz_1:-2.5|c|@0.5", Packet{Bucket: "foo.bar-baz_1", Value: -2.5, Modifier: "c", Sampling: 0.5}},
+		{"foo:42|g", Packet{Bucket: "foo", Value: 42, Modifier: "g", Sampling: 1}},
+		{"foo:+5|g", Packet{Bucket: "foo", Value: 5, Modifier: "g", Relative: true, Sampling: 1}},
+		{"foo:-3|g", Packet{Bucket: "foo", Value: -3, Modifier: "g", Relative: true, Sampling: 1}},
+		{"foo:1e3|ms", Packet{Bucket: "foo", Value: 1000, Modifier: "ms", Sampling: 1}},
+		{"foo:user-1|s", Packet{Bucket: "foo", Member: "user-1", Modifier: "s", Sampling: 1}},
+		{"foo:1|c|#host:a,env:prod", Packet{Bucket: "foo", Value: 1, Modifier: "c", Sampling: 1, Tags: []string{"env:prod", "host:a"}}},
+		{"foo:1|c|@0.1|#env:prod", Packet{Bucket: "foo", Value: 1, Modifier: "c", Sampling: 0.1, Tags: []string{"env:prod"}}},
+		{"foo:1|c|#env:prod|@0.1", Packet{Bucket: "foo", Value: 1, Modifier: "c", Sampling: 0.1, Tags: []string{"env:prod"}}},
+	}
+	p := NewParser()
+	for _, tc := range valid {
+		var packet Packet
+		if err := p.parseLine([]byte(tc.line), &packet); err != nil {
+			t.Errorf("%q: unexpected error %v", tc.line, err)
+			continue
+		}
+		if !reflect.DeepEqual(packet, tc.packet) {
+			t.Errorf("%q: got %+v, want %+v", tc.line, packet, tc.packet)
+		}
+	}
+
+	invalid := []struct {
+		line string
+		err  error
+	}{
+		{"foo", errBadLine},
+		{":1|c", errBadLine},
+		{"fo o:1|c", errBadLine},
+		{"foo:|c", errBadLine},
+		{"foo:1", errBadLine},
+		{"foo:1|", errUnknownType},
+		{"foo:1|x", errUnknownType},
+		{"foo:1|cc", errUnknownType},
+		{"foo:abc|c", errBadValue},
+		{"foo:NaN|ms", errBadValue},
+		{"foo:Inf|g", errBadValue},
+		{"foo:0x10|c", errBadValue},
+		{"foo:1-2|c", errBadValue},
+		{"foo:1e999|ms", errBadValue},
+		{"foo:1|c|@", errBadLine},
+		{"foo:1|c|@0", errBadSampleRate},
+		{"foo:1|c|@1.5", errBadSampleRate},
+		{"foo:1|c|@x", errBadSampleRate},
+		{"foo:1|c|@0.5|@0.5", errBadLine},
+		{"foo:1|c|#a b", errBadLine},
+		{"foo:1|c|#a|#b", errBadLine},
+		{"foo:1|c||", errBadLine},
+		{"foo:1|c|x", errBadLine},
+	}
+	for _, tc := range invalid {
+		var packet Packet
+		if err := p.parseLine([]byte(tc.line), &packet); err != tc.err {
+			t.Errorf("%q: got error %v, want %v", tc.line, err, tc.err)
+		}
+	}
+}
+
+func TestParseMessage(t *testing.T) {
+	var buckets []string
+	var rejected []string
+	p := NewParser()
+	p.parseMessage([]byte("a:1|c\r\n\nbad\nb:2|g\nc:3|ms"), func(packet *Packet) {
+		buckets = append(buckets, packet.Bucket)
+	}, func(line []byte, err error) {
+		rejected = append(rejected, string(line))
+	})
+	if !reflect.DeepEqual(buckets, []string{"a", "b", "c"}) {
+		t.Errorf("got buckets %v", buckets)
+	}
+	if !reflect.DeepEqual(rejected, []string{"bad"}) {
+		t.Errorf("got rejected lines %v", rejected)
+	}
+}
+
+func TestParseMessageOversize(t *testing.T) {
+	var errs []error
+	long := "a:1|c|#" + strings.Repeat("x", *maxLineLength)
+	NewParser().parseMessage([]byte(long+"\nb:1|c"), func(packet *Packet) {}, func(line []byte, err error) {
+		errs = append(errs, err)
+	})
+	if !reflect.DeepEqual(errs, []error{errOversize}) {
+		t.Errorf("got errors %v", errs)
+	}
+}
+
+// format_packet is the inverse of parseLine, used to check round trips.
+func format_packet(p *Packet) string {
+	var value string
+	if p.Modifier == "s" {
+		value = p.Member
+	} else {
+		value = strconv.FormatFloat(p.Value, 'g', -1, 64)
+		if p.Relative && !math.Signbit(p.Value) {
+			value = "+" + value
+		}
+	}
+	line := p.Bucket + ":" + value + "|" + p.Modifier
+	if p.Sampling != 1 {
+		line += "|@" + strconv.FormatFloat(p.Sampling, 'g', -1, 64)
+	}
+	if len(p.Tags) > 0 {
+		line += "|#" + strings.Join(p.Tags, ",")
+	}
+	return line
+}
+
+func FuzzParseLine(f *testing.F) {
+	for _, seed := range []string{
+		"foo:1|c", "foo:+5|g", "foo:-1.5e3|ms|@0.25", "foo:x|s|#env:prod,host", "foo:1|c|#a|@0.5", "foo:-0|g",
+	} {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, line []byte) {
+		var packet Packet
+		p := NewParser()
+		if err := p.parseLine(line, &packet); err != nil {
+			return
+		}
+		if packet.Modifier == "s" && strings.ContainsAny(packet.Member, "|\n") {
+			t.Fatalf("%q: set member %q contains a separator", line, packet.Member)
+		}
+		formatted := format_packet(&packet)
+		var again Packet
+		if err := NewParser().parseLine([]byte(formatted), &again); err != nil {
+			t.Fatalf("%q: reformatted as %q which fails to parse: %v", line, formatted, err)
+		}
+		if !reflect.DeepEqual(packet, again) {
+			t.Fatalf("%q: round trip through %q gives %+v, want %+v", line, formatted, again, packet)
+		}
+	})
+}
+
+var benchMessage = []byte("api.requests:1|c\napi.latency:12.5|ms|@0.5\nqueue.depth:42|g\napi.users:u123|s\napi.requests:1|c|#env:prod,host:a\n")
+
+func BenchmarkParser(b *testing.B) {
+	b.ReportAllocs()
+	b.SetBytes(int64(len(benchMessage)))
+	n := 0
+	for i := 0; i < b.N; i++ {
+		p := parserPool.Get().(*Parser)
+		p.parseMessage(benchMessage, func(packet *Packet) { n++ }, func(line []byte, err error) {})
+		parserPool.Put(p)
+	}
+}
+
+// The regexp based parser this one replaced, kept for comparison.
+var packetRegexp = regexp.MustCompile("([a-zA-Z0-9_\\.\\-]+):([^:|\\s]+)\\|(c|g|ms|s)(\\|@([0-9\\.]+))?(\\|#([a-zA-Z0-9_\\.\\-:,]+))?")
+
+func BenchmarkRegexParser(b *testing.B) {
+	b.ReportAllocs()
+	b.SetBytes(int64(len(benchMessage)))
+	n := 0
+	for i := 0; i < b.N; i++ {
+		for _, item := range packetRegexp.FindAllStringSubmatch(string(benchMessage), -1) {
+			var packet Packet
+			if item[3] == "s" {
+				packet.Member = item[2]
+			} else {
+				packet.Value, _ = strconv.ParseFloat(item[2], 64)
+			}
+			sampleRate, err := strconv.ParseFloat(item[5], 64)
+			if err != nil {
+				sampleRate = 1
+			}
+			packet.Bucket = item[1]
+			packet.Modifier = item[3]
+			packet.Sampling = sampleRate
+			packet.Tags = parse_tags(item[7])
+			n++
+		}
+	}
+}
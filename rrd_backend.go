@@ -3,6 +3,7 @@
 package main
 
 import (
+	"context"
 	"os"
 	"./rrd"
 	"./embedded"
@@ -14,124 +15,314 @@ import (
 	"strconv"
 	"time"
 	"flag"
-)
-
-const (
-    RRD_STEP = 10
-    RRD_DIR = "data"
+	"sync"
 )
 
 var (
 	webAddress       = flag.String("webface", ":5400", "HTTP web interface address")
+	rrdDir           = flag.String("rrd-dir", "data", "Directory of the RRD files")
+	rrdStep          = flag.Int64("rrd-step", 10, "Seconds between the primary data points of new RRD files")
+	rrdRetention     = flag.String("rrd-retention", "10s:4h,50s:3d,5m:31d,1h:93d,4h:1y", "Archives of new RRD files as comma-separated resolution:duration pairs")
 )
 
+// RrdArchive is an AVERAGE archive of steps primary data points per row.
+type RrdArchive struct {
+    steps int64
+    rows  int64
+}
+
+// parse_span parses a number of seconds with a unit: 10s, 5m, 4h, 3d,
+// 2w or 1y.
+func parse_span(s string) (int64, error) {
+    units := map[byte]int64{'s': 1, 'm': 60, 'h': 60 * 60, 'd': 24 * 60 * 60, 'w': 7 * 24 * 60 * 60, 'y': 365 * 24 * 60 * 60}
+    if len(s) < 2 || units[s[len(s) - 1]] == 0 {
+        return 0, fmt.Errorf("bad time span '%s'", s)
+    }
+    n, err := strconv.ParseInt(s[:len(s) - 1], 10, 64)
+    if err != nil || n <= 0 {
+        return 0, fmt.Errorf("bad time span '%s'", s)
+    }
+    return n * units[s[len(s) - 1]], nil
+}
+
+// parse_retention turns "10s:4h,5m:31d" into archives for RRD files with
+// the given step. Every resolution must be a multiple of the step.
+func parse_retention(s string, step int64) ([]RrdArchive, error) {
+    var archives []RrdArchive
+    for _, item := range strings.Split(s, ",") {
+        parts := strings.Split(strings.TrimSpace(item), ":")
+        if len(parts) != 2 {
+            return nil, fmt.Errorf("expected resolution:duration in '%s'", item)
+        }
+        resolution, err := parse_span(parts[0])
+        if err != nil {
+            return nil, err
+        }
+        duration, err := parse_span(parts[1])
+        if err != nil {
+            return nil, err
+        }
+        if resolution % step != 0 {
+            return nil, fmt.Errorf("resolution %s is not a multiple of the %ds step", parts[0], step)
+        }
+        if duration < resolution {
+            return nil, fmt.Errorf("duration %s is shorter than resolution %s", parts[1], parts[0])
+        }
+        archives = append(archives, RrdArchive{resolution / step, duration / resolution})
+    }
+    return archives, nil
+}
+
 type RrdBackend struct {
+    now time.Time
+    // Layout of new files, fixed at startup.
+    step int64
+    archives []RrdArchive
+    // Data sources of every timing file written so far; files created
+    // with other -percentiles only get the values they have room for.
+    timingDS map[string]map[string]bool
 }
 
-func NewRrdBackend() *RrdBackend {
+func NewRrdBackend() (*RrdBackend, error) {
     var b RrdBackend;
-	go rrdHttpServer()
-    log.Printf("Writing to RRD files at %s/\n", RRD_DIR)
-    return &b;
+    b.timingDS = make(map[string]map[string]bool)
+    var err error
+    b.step = *rrdStep
+    b.archives, err = parse_retention(*rrdRetention, b.step)
+    if err != nil {
+        return nil, fmt.Errorf("bad -rrd-retention: %s", err.Error())
+    }
+	webServerOnce.Do(func() { go rrdHttpServer() })
+    log.Printf("Writing to RRD files at %s/\n", *rrdDir)
+    return &b, nil
+}
+
+func init() {
+    registerBackend("rrd", BackendType{
+        options: map[string]bool{},
+        unique:  true,
+        build: func(c BackendConfig) (StatsdBackend, error) {
+            b, err := NewRrdBackend()
+            if err != nil {
+                return nil, err
+            }
+            return b, nil
+        },
+    })
 }
 
-func (b *RrdBackend) beginAggregation() {
-    ensure_rrd_dir_exists()
+func (b *RrdBackend) beginAggregation(ctx context.Context, ts time.Time) error {
+    b.now = ts
+    return ensure_rrd_dir_exists()
+}
+func (b *RrdBackend) endAggregation(ctx context.Context) error {
+    return nil
 }
-func (b *RrdBackend) endAggregation() {
+func (b *RrdBackend) handleCounter(name string, tags []string, count float64, count_ps float64) error {
+    return b.writeGaugeRrd(rrd_metric_name(name, tags), count_ps)
 }
-func (b *RrdBackend) handleCounter(name string, count int64, count_ps float64) {
-    write_to_gauge_rrd(name, count_ps)
+func (b *RrdBackend) handleGauge(name string, tags []string, gs GaugeStats) error {
+    for _, s := range gs.series() {
+        if err := b.writeGaugeRrd(rrd_metric_name(series_name(name, s), tags), s.v); err != nil {
+            return err
+        }
+    }
+    return nil
 }
-func (b *RrdBackend) handleGauge(name string, v float64) {
-    write_to_gauge_rrd(name, v)
+func (b *RrdBackend) handleTiming(name string, tags []string, td TimerDistribution) error {
+    metric := rrd_metric_name(name, tags) + ".timing"
+    filename := mk_metric_filename(metric)
+    names, values := timing_ds_values(td)
+    if err := b.ensureTimingRrd(metric, names); err != nil {
+        return err
+    }
+    known, ok := b.timingDS[filename]
+    if !ok {
+        known = make(map[string]bool)
+        ds, err := rrd_ds_names(filename)
+        if err != nil {
+            return fmt.Errorf("could not read dist-rrd file info: %s", err.Error())
+        }
+        for _, n := range ds {
+            known[n] = true
+        }
+        b.timingDS[filename] = known
+    }
+    return write_to_timing_rrd(filename, b.now, names, values, known)
 }
-func (b *RrdBackend) handleTiming(name string, td TimerDistribution) {
-    write_to_timing_rrd(name, td.min, td.max, td.mean, td.q_50, td.q_90, td.count_ps);
+func (b *RrdBackend) handleSet(name string, tags []string, count int64) error {
+    return b.writeGaugeRrd(rrd_metric_name(name, tags), float64(count))
 }
 
-func ensure_rrd_dir_exists() {
-    if _, err := os.Stat(RRD_DIR); err == nil {
-        return
+// rrd_metric_name encodes tags into the file name as
+// "name,tag=value,...": ':' would break rrdtool DEF arguments and ';'
+// is already used to list several metrics in one web interface URL.
+func rrd_metric_name(name string, tags []string) string {
+    if len(tags) == 0 {
+        return name
     }
-    os.Mkdir(RRD_DIR, 0755)
+    return name + "," + strings.Replace(strings.Join(tags, ","), ":", "=", -1)
 }
 
-func mk_common_rrd(filename string) *rrd.Creator {
-    t := time.Unix(time.Now().Unix() - (RRD_STEP), 0)
-    c := rrd.NewCreator(filename, t, (RRD_STEP))
-    c.RRA("AVERAGE", 0.5, 1,         4 * 60 * 60 / (RRD_STEP))
-    c.RRA("AVERAGE", 0.5, 5,         3 * 24 * 60 * 60 / (5 * (RRD_STEP)))
-    c.RRA("AVERAGE", 0.5, 30,       31 * 24 * 60 * 60 / (30 * (RRD_STEP)))
-    c.RRA("AVERAGE", 0.5, 6 * 60,    3 * 31 * 24 * 60 * 60 / (6 * 60 * (RRD_STEP)))
-    c.RRA("AVERAGE", 0.5, 24 * 60, 365 * 24 * 60 * 60 / (24 * 60 * (RRD_STEP)))
+func ensure_rrd_dir_exists() error {
+    if _, err := os.Stat(*rrdDir); err == nil {
+        return nil
+    }
+    return os.Mkdir(*rrdDir, 0755)
+}
+
+func (b *RrdBackend) newCreator(filename string) *rrd.Creator {
+    t := time.Unix(b.now.Unix() - b.step, 0)
+    c := rrd.NewCreator(filename, t, uint(b.step))
+    for _, a := range b.archives {
+        c.RRA("AVERAGE", 0.5, a.steps, a.rows)
+    }
     return c
 }
 
 func mk_metric_filename(metric string) string {
-    return RRD_DIR + "/" + metric + ".rrd"
+    return *rrdDir + "/" + metric + ".rrd"
 }
 
-func ensure_gauge_rrd_exists(metric string) {
+func (b *RrdBackend) ensureGaugeRrd(metric string) error {
     filename := mk_metric_filename(metric)
     if _, err := os.Stat(filename); err == nil {
-        return
+        return nil
     }
     if *debug {
-        log.Println("Creating rrd %s\n", filename)
+        log.Printf("Creating rrd %s\n", filename)
     }
-    c := mk_common_rrd(filename)
-    c.DS("num", "GAUGE", 2 * (RRD_STEP), 0, 2147483647)
+    c := b.newCreator(filename)
+    c.DS("num", "GAUGE", 2 * b.step, 0, 2147483647)
     err := c.Create(true)
     if err != nil {
-        panic("could not create rrd file: " + err.Error())
+        return fmt.Errorf("could not create rrd file %s: %s", filename, err.Error())
     }
+    return nil
 }
 
-func write_to_gauge_rrd(metric string, value float64) {
+func (b *RrdBackend) writeGaugeRrd(metric string, value float64) error {
     metric = metric + ".gauge"
     filename := mk_metric_filename(metric)
-    ensure_gauge_rrd_exists(metric)
+    if err := b.ensureGaugeRrd(metric); err != nil {
+        return err
+    }
     u := rrd.NewUpdater(filename)
 
-    err := u.Update(time.Now(), value)
+    err := u.Update(b.now, value)
     if err != nil {
-        panic("could not update gauge rrd file: " + err.Error())
+        return fmt.Errorf("could not update gauge rrd file %s: %s", filename, err.Error())
     }
+    return nil
 }
 
-func ensure_timing_rrd_exists(metric string) {
+// percentile_ds names the data source of a percentile. The median and
+// the 90th percentile keep the names of the original fixed layout.
+func percentile_ds(p float64) string {
+    if p == 50 {
+        return "med"
+    }
+    return "q" + percentile_name(p)
+}
+
+func is_percentile_ds(name string) bool {
+    return name == "med" || strings.HasPrefix(name, "q")
+}
+
+func timing_ds_values(td TimerDistribution) ([]string, []interface{}) {
+    names := []string{"min", "max", "avg"}
+    values := []interface{}{td.min, td.max, td.mean}
+    has_median := false
+    for _, p := range td.percentiles {
+        names = append(names, percentile_ds(p.p))
+        values = append(values, p.v)
+        has_median = has_median || p.p == 50
+    }
+    if !has_median {
+        names = append(names, "med")
+        values = append(values, td.median)
+    }
+    // means of the samples below each percentile
+    for _, p := range td.percentiles {
+        names = append(names, "m" + percentile_name(p.p))
+        values = append(values, p.mean)
+    }
+    names = append(names, "sum", "sumsq", "std", "num")
+    values = append(values, td.sum, td.sum_squares, td.stddev, td.count_ps)
+    // samples per second in each histogram bin
+    for _, bin := range td.histogram {
+        names = append(names, bin_name(bin.upper))
+        if td.count > 0 {
+            values = append(values, bin.count / td.count * td.count_ps)
+        } else {
+            values = append(values, 0.0)
+        }
+    }
+    return names, values
+}
+
+// Sums outgrow the usual 2^31 limit of the data sources quickly.
+func timing_ds_max(name string) interface{} {
+    if name == "sum" || name == "sumsq" {
+        return "U"
+    }
+    return 2147483647
+}
+
+// rrd_ds_names lists the data sources of an RRD file in file order.
+func rrd_ds_names(filename string) ([]string, error) {
+    info, err := rrd.Info(filename)
+    if err != nil {
+        return nil, err
+    }
+    index, _ := info["ds.index"].(map[string]interface{})
+    names := make([]string, len(index))
+    for name, i := range index {
+        n, ok := i.(uint)
+        if !ok || int(n) >= len(names) {
+            return nil, fmt.Errorf("bad index of data source %s", name)
+        }
+        names[n] = name
+    }
+    return names, nil
+}
+
+func (b *RrdBackend) ensureTimingRrd(metric string, names []string) error {
     filename := mk_metric_filename(metric)
     if _, err := os.Stat(filename); err == nil {
-        return
+        return nil
     }
     if *debug {
-        log.Println("Creating dist rrd %s\n", filename)
-    }
-    c := mk_common_rrd(filename)
-    c.DS("min", "GAUGE", 2 * (RRD_STEP), 0, 2147483647)
-    c.DS("max", "GAUGE", 2 * (RRD_STEP), 0, 2147483647)
-    c.DS("avg", "GAUGE", 2 * (RRD_STEP), 0, 2147483647)
-    c.DS("med", "GAUGE", 2 * (RRD_STEP), 0, 2147483647)
-    c.DS("q90", "GAUGE", 2 * (RRD_STEP), 0, 2147483647)
-    c.DS("num", "GAUGE", 2 * (RRD_STEP), 0, 2147483647)
+        log.Printf("Creating dist rrd %s\n", filename)
+    }
+    c := b.newCreator(filename)
+    for _, name := range names {
+        c.DS(name, "GAUGE", 2 * b.step, 0, timing_ds_max(name))
+    }
     err := c.Create(true)
     if err != nil {
-        panic("could not create dist-rrd file: " + err.Error())
+        return fmt.Errorf("could not create dist-rrd file %s: %s", filename, err.Error())
     }
+    return nil
 }
 
-func write_to_timing_rrd(metric string, min float64, max float64, avg float64,
-                         med float64, q90 float64, num float64) {
-    metric = metric + ".timing"
-    filename := mk_metric_filename(metric)
-    ensure_timing_rrd_exists(metric)
+func write_to_timing_rrd(filename string, now time.Time, names []string, values []interface{}, known map[string]bool) error {
+    var template []string
+    args := []interface{}{now}
+    for i, name := range names {
+        if known[name] {
+            template = append(template, name)
+            args = append(args, values[i])
+        }
+    }
     u := rrd.NewUpdater(filename)
+    u.SetTemplate(template...)
 
-    err := u.Update(time.Now(), min, max, avg, med, q90, num)
+    err := u.Update(args...)
     if err != nil {
-        panic("could not update dist-rrd file: " + err.Error())
+        return fmt.Errorf("could not update dist-rrd file %s: %s", filename, err.Error())
     }
+    return nil
 }
 
 func get_metric_type(metric string) string {
@@ -148,6 +339,9 @@ func http_metric_page(w http.ResponseWriter, r *http.Request, metric string, met
     w.Header().Set("Content-type", "text/html")
     if metric_type == "timing" {
         fmt.Fprintf(w, "<img src=\"/%s/timing/%s/%d/\">", metric, path_tail, minutes)
+        if len(histogram_ds(mk_metric_filename(metric + ".timing"))) > 0 {
+            fmt.Fprintf(w, "<img src=\"/%s/histogram/%s/%d/\">", metric, path_tail, minutes)
+        }
     }
     if file_exists(mk_metric_filename(metric + ".bad.gauge")) {
         fmt.Fprintf(w, "<img src=\"/%s/gaugebad/%s/%d\">", metric, path_tail, minutes)
@@ -157,6 +351,23 @@ func http_metric_page(w http.ResponseWriter, r *http.Request, metric string, met
     fmt.Fprintf(w, "<br/>")
 }
 
+// histogram_ds lists the histogram bin data sources of a timing file.
+func histogram_ds(filename string) []string {
+    names, err := rrd_ds_names(filename)
+    if err != nil {
+        return nil
+    }
+    var bins []string
+    for _, name := range names {
+        if strings.HasPrefix(name, "bin_") {
+            bins = append(bins, name)
+        }
+    }
+    return bins
+}
+
+var histogram_colors = []string{"88cc88", "cccc66", "ffaa44", "ee6655", "aa3388", "6644aa", "224488"}
+
 func concat(old1, old2 []string) []string {
     newslice := make([]string, len(old1) + len(old2))
     copy(newslice, old1)
@@ -202,7 +413,7 @@ func http_main(w http.ResponseWriter, r *http.Request) {
             path = concat([]string{"index", "html"}, path[1:])
         }
 
-        files, err := ioutil.ReadDir(RRD_DIR)
+        files, err := ioutil.ReadDir(*rrdDir)
         if err != nil {
             fmt.Fprintf(w, "Error while enumerating metrics: %s", err.Error())
             return
@@ -300,29 +511,83 @@ func http_main(w http.ResponseWriter, r *http.Request) {
             g.GPrint("v_last", "last = %.0lf")
             /*g.GPrint("v_q90", "q90 = %.0lf")*/
             g.GPrint("v_rat", "bad = %.0lf%%")
+        } else if metric_type == "histogram" {
+            bins := histogram_ds(filename)
+            if len(bins) == 0 {
+                fmt.Fprintf(w, "no histogram for metric: %s", metric)
+                return
+            }
+            g.SetTitle(metric + " latency breakdown")
+            g.SetLowerLimit(0)
+            g.SetVLabel("events / second")
+            for i, bin := range bins {
+                g.Def(bin, filename, bin, "AVERAGE")
+                label := "<= " + strings.Replace(strings.TrimPrefix(bin, "bin_"), "_", ".", -1) + " ms"
+                if bin == "bin_inf" {
+                    label = "slower"
+                }
+                color := histogram_colors[i % len(histogram_colors)]
+                if i == 0 {
+                    g.Area(bin, color, label)
+                } else {
+                    g.Area(bin, color, label, "STACK")
+                }
+            }
         } else if metric_type == "timing" {
             g.SetTitle(metric)
             g.SetLowerLimit(0)
             g.SetVLabel("ms")
             g.SetUnitsExponent(0)
+            ds_names, err := rrd_ds_names(filename)
+            if err != nil {
+                fmt.Fprintf(w, "graph error: %s", err.Error())
+                return
+            }
+            // The 90th percentile (or the highest one the file has) is
+            // shaded, the others are drawn as thin lines.
+            var pcts []string
+            main_pct := ""
+            for _, ds := range ds_names {
+                if is_percentile_ds(ds) {
+                    pcts = append(pcts, ds)
+                    if main_pct != "q90" {
+                        main_pct = ds
+                    }
+                }
+            }
             g.Def("tmin", filename, "min", "AVERAGE")
             g.Def("tmax", filename, "max", "AVERAGE")
-            g.Def("q50", filename, "med", "AVERAGE")
-            g.Def("q90", filename, "q90", "AVERAGE")
             g.Def("tavg", filename, "avg", "AVERAGE")
+            for _, ds := range pcts {
+                g.Def(ds, filename, ds, "AVERAGE")
+                g.VDef("v_" + ds, ds + ",AVERAGE")
+            }
             g.VDef("v_max", "tmax,MAXIMUM")
             g.VDef("v_min", "tmin,MINIMUM")
             g.VDef("v_avg", "tavg,AVERAGE")
-            g.VDef("v_q90", "q90,AVERAGE")
-            g.Area("q90", "eeeeff")
+            if main_pct != "" {
+                g.Area(main_pct, "eeeeff")
+            }
             g.Line(2, "tavg", "000088")
-            g.Line(1, "q90", "000088")
+            for _, ds := range pcts {
+                if ds == main_pct {
+                    g.Line(1, ds, "000088")
+                } else {
+                    g.Line(1, ds, "8888bb")
+                }
+            }
             g.Line(1, "tmin", "bbbb88")
             /*g.Line(1, "tmax", "bbbb88")*/
             g.GPrint("v_min", "min = %.0lf")
             g.GPrint("v_max", "max = %.0lf")
             g.GPrint("v_avg", "avg = %.0lf")
-            g.GPrint("v_q90", "q90 = %.0lf")
+            for _, ds := range pcts {
+                label := ds
+                if ds == "med" {
+                    label = "q50"
+                }
+                g.GPrint("v_" + ds, label + " = %.0lf")
+            }
         }
 
         g.SetSize(600, 130)
@@ -338,9 +603,22 @@ func http_main(w http.ResponseWriter, r *http.Request) {
     }
 }
 
+// The web interface starts with the first RrdBackend and outlives
+// reloads.
+var webServerOnce sync.Once
+
 func rrdHttpServer() {
     log.Printf("Web interface available at %s", *webAddress)
     http.HandleFunc("/", http_main)
-    http.ListenAndServe(*webAddress, nil)
+    server := &http.Server{Addr: *webAddress}
+    atShutdown(func() {
+        ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+        defer cancel()
+        server.Shutdown(ctx)
+    })
+    err := server.ListenAndServe()
+    if err != nil && err != http.ErrServerClosed {
+        log.Printf("Web interface failed: %s", err.Error())
+    }
 }
 
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"math"
+	"sort"
+)
+
+// Values closer to zero than this are all counted as zero.
+const SKETCH_MIN_VALUE = 1e-9
+
+// Sketch is a mergeable quantile sketch for timer values (DDSketch):
+// samples are counted in buckets whose bounds grow geometrically by
+// gamma = (1+alpha)/(1-alpha). Any quantile it returns is within a
+// relative error of alpha of the sample at that rank, whatever the
+// distribution. Memory grows with log(max/min)/alpha rather than with
+// the number of samples: about 1000 buckets cover 1us to 1000s at 1%.
+// Count, sum, sum of squares, min and max are kept exactly.
+type Sketch struct {
+	alpha    float64
+	gamma    float64
+	logGamma float64
+
+	pos  map[int]float64
+	neg  map[int]float64
+	zero float64
+
+	count      float64
+	sum        float64
+	sumSquares float64
+	min        float64
+	max        float64
+}
+
+func NewSketch(alpha float64) *Sketch {
+	var s Sketch
+	s.alpha = alpha
+	s.gamma = (1 + alpha) / (1 - alpha)
+	s.logGamma = math.Log(s.gamma)
+	s.pos = make(map[int]float64)
+	s.neg = make(map[int]float64)
+	return &s
+}
+
+func (s *Sketch) index(v float64) int {
+	return int(math.Ceil(math.Log(v) / s.logGamma))
+}
+
+// value returns the representative of bucket i, the point of
+// (gamma^(i-1), gamma^i] with the smallest relative distance to both ends.
+func (s *Sketch) value(i int) float64 {
+	return 2 * math.Pow(s.gamma, float64(i)) / (s.gamma + 1)
+}
+
+// add records weight samples of value v.
+func (s *Sketch) add(v float64, weight float64) {
+	if s.count == 0 || v < s.min {
+		s.min = v
+	}
+	if s.count == 0 || v > s.max {
+		s.max = v
+	}
+	s.count += weight
+	s.sum += v * weight
+	s.sumSquares += v * v * weight
+
+	if v > SKETCH_MIN_VALUE {
+		s.pos[s.index(v)] += weight
+	} else if v < -SKETCH_MIN_VALUE {
+		s.neg[s.index(-v)] += weight
+	} else {
+		s.zero += weight
+	}
+}
+
+// merge adds all samples of o, which must have the same alpha.
+func (s *Sketch) merge(o *Sketch) {
+	if o.count == 0 {
+		return
+	}
+	if s.count == 0 || o.min < s.min {
+		s.min = o.min
+	}
+	if s.count == 0 || o.max > s.max {
+		s.max = o.max
+	}
+	s.count += o.count
+	s.sum += o.sum
+	s.sumSquares += o.sumSquares
+	s.zero += o.zero
+	for i, w := range o.pos {
+		s.pos[i] += w
+	}
+	for i, w := range o.neg {
+		s.neg[i] += w
+	}
+}
+
+type sketchBucket struct {
+	value  float64
+	weight float64
+}
+
+// buckets lists the non-empty buckets in increasing value order.
+func (s *Sketch) buckets() []sketchBucket {
+	result := make([]sketchBucket, 0, len(s.neg)+len(s.pos)+1)
+
+	neg := make([]int, 0, len(s.neg))
+	for i := range s.neg {
+		neg = append(neg, i)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(neg)))
+	for _, i := range neg {
+		result = append(result, sketchBucket{-s.value(i), s.neg[i]})
+	}
+
+	if s.zero > 0 {
+		result = append(result, sketchBucket{0, s.zero})
+	}
+
+	pos := make([]int, 0, len(s.pos))
+	for i := range s.pos {
+		pos = append(pos, i)
+	}
+	sort.Ints(pos)
+	for _, i := range pos {
+		result = append(result, sketchBucket{s.value(i), s.pos[i]})
+	}
+	return result
+}
+
+// quantiles returns the values at the given ranks (0 <= q <= 1, sorted
+// ascending). The rank of q is q*count, the same sample a sorted list of
+// all values would have at index int(q*count).
+func (s *Sketch) quantiles(qs []float64) []float64 {
+	result := make([]float64, len(qs))
+	if s.count == 0 {
+		return result
+	}
+	buckets := s.buckets()
+	b := 0
+	cumulative := 0.0
+	for i, q := range qs {
+		rank := q * s.count
+		for b < len(buckets) && cumulative+buckets[b].weight <= rank {
+			cumulative += buckets[b].weight
+			b++
+		}
+		if b == len(buckets) {
+			result[i] = s.max
+			continue
+		}
+		result[i] = math.Max(s.min, math.Min(s.max, buckets[b].value))
+	}
+	return result
+}
+
+// lower returns the count, sum and sum of squares of the samples below
+// rank q*count, like the mean_90 and sum_90 of the reference statsd. A
+// bucket straddling the rank contributes proportionally.
+func (s *Sketch) lower(q float64) (count float64, sum float64, sumSquares float64) {
+	if q >= 1 {
+		return s.count, s.sum, s.sumSquares
+	}
+	rank := q * s.count
+	for _, b := range s.buckets() {
+		w := math.Min(b.weight, rank-count)
+		if w <= 0 {
+			break
+		}
+		v := math.Max(s.min, math.Min(s.max, b.value))
+		count += w
+		sum += w * v
+		sumSquares += w * v * v
+	}
+	return count, sum, sumSquares
+}
+
+// histogram splits the samples into bins with the given sorted upper
+// bounds plus a last unbounded bin. A sample is placed by its bucket, so
+// samples within alpha of a bound may land in the neighbouring bin.
+func (s *Sketch) histogram(bounds []float64) []HistogramBin {
+	bins := make([]HistogramBin, len(bounds)+1)
+	for i, b := range bounds {
+		bins[i].upper = b
+	}
+	bins[len(bounds)].upper = math.Inf(1)
+	if s.count == 0 {
+		return bins
+	}
+	i := 0
+	for _, b := range s.buckets() {
+		v := math.Max(s.min, math.Min(s.max, b.value))
+		for i < len(bounds) && v > bounds[i] {
+			i++
+		}
+		bins[i].count += b.weight
+	}
+	return bins
+}
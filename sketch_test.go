@@ -0,0 +1,87 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func TestSketchQuantilesWithinErrorBound(t *testing.T) {
+	const alpha = 0.01
+	qs := []float64{0, 0.25, 0.5, 0.75, 0.9, 0.99, 0.999, 1}
+	r := rand.New(rand.NewSource(1))
+	for _, dist := range []func() float64{
+		func() float64 { return r.Float64() * 1000 },
+		func() float64 { return math.Exp(r.NormFloat64() * 3) },
+		func() float64 { return r.NormFloat64() * 50 },
+	} {
+		s := NewSketch(alpha)
+		values := make([]float64, 10000)
+		sum := 0.0
+		for i := range values {
+			values[i] = dist()
+			sum += values[i]
+			s.add(values[i], 1)
+		}
+		sort.Float64s(values)
+
+		if s.count != float64(len(values)) || s.min != values[0] || s.max != values[len(values)-1] {
+			t.Errorf("got count %f min %f max %f, want exact values", s.count, s.min, s.max)
+		}
+		if math.Abs(s.sum-sum) > 1e-6*math.Abs(sum) {
+			t.Errorf("got sum %f, want %f", s.sum, sum)
+		}
+		for i, got := range s.quantiles(qs) {
+			idx := int(qs[i] * float64(len(values)))
+			if idx >= len(values) {
+				idx = len(values) - 1
+			}
+			want := values[idx]
+			if math.Abs(got-want) > alpha*math.Abs(want)+SKETCH_MIN_VALUE {
+				t.Errorf("q%g: got %f, want %f within %g", qs[i], got, want, alpha)
+			}
+		}
+	}
+}
+
+func TestSketchMerge(t *testing.T) {
+	a, b, all := NewSketch(0.01), NewSketch(0.01), NewSketch(0.01)
+	for i := 1; i <= 1000; i++ {
+		if i%3 == 0 {
+			a.add(float64(i), 1)
+		} else {
+			b.add(float64(i), 1)
+		}
+		all.add(float64(i), 1)
+	}
+	a.merge(b)
+	qs := []float64{0.1, 0.5, 0.9}
+	got, want := a.quantiles(qs), all.quantiles(qs)
+	for i := range qs {
+		if got[i] != want[i] {
+			t.Errorf("q%g: merged sketch gives %f, want %f", qs[i], got[i], want[i])
+		}
+	}
+	if a.count != all.count || a.min != all.min || a.max != all.max || a.sum != all.sum {
+		t.Errorf("merged sketch has count %f min %f max %f sum %f", a.count, a.min, a.max, a.sum)
+	}
+}
+
+func TestSketchHistogram(t *testing.T) {
+	s := NewSketch(0.01)
+	for _, v := range []float64{1, 5, 20, 30, 40, 100, 500, 1000} {
+		s.add(v, 1)
+	}
+	s.add(7, 10)
+	bins := s.histogram([]float64{10, 50, 200})
+	want := []float64{12, 3, 1, 2}
+	for i, bin := range bins {
+		if bin.count != want[i] {
+			t.Errorf("bin %d (<= %g): got %f, want %f", i, bin.upper, bin.count, want[i])
+		}
+	}
+	if !math.IsInf(bins[len(bins)-1].upper, 1) {
+		t.Errorf("last bin is bounded by %f", bins[len(bins)-1].upper)
+	}
+}
@@ -1,9 +1,12 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
+	"os"
 	"strings"
+	"time"
 )
 
 type StdoutBackend struct {
@@ -17,20 +20,60 @@ func NewStdoutBackend(pattern string) *StdoutBackend {
     return &b;
 }
 
-func (b *StdoutBackend) beginAggregation() {
+func init() {
+	registerBackend("stdout", BackendType{
+		options: map[string]bool{"prefix": true},
+		build: func(c BackendConfig) (StatsdBackend, error) {
+			return NewStdoutBackend(c.options["prefix"]), nil
+		},
+	})
 }
-func (b *StdoutBackend) endAggregation() {
+
+func (b *StdoutBackend) beginAggregation(ctx context.Context, ts time.Time) error {
+	return nil
+}
+func (b *StdoutBackend) endAggregation(ctx context.Context) error {
+	return nil
 }
-func (b *StdoutBackend) handleCounter(name string, count int64, count_ps float64) {
+func (b *StdoutBackend) handleCounter(name string, tags []string, count float64, count_ps float64) error {
 	if strings.HasPrefix(name, b.prefix) {
-		fmt.Printf("%s %d\n", name, count)
+		fmt.Printf("%s %f\n", metric_key(name, tags), count)
 	}
+	return nil
 }
-func (b *StdoutBackend) handleGauge(name string, v float64) {
+func (b *StdoutBackend) handleGauge(name string, tags []string, gs GaugeStats) error {
 	if strings.HasPrefix(name, b.prefix) {
-		fmt.Printf("%s %f\n", name, v)
+		for _, s := range gs.series() {
+			if gs.relative {
+				fmt.Printf("%s %f (relative)\n", metric_key(series_name(name, s), tags), s.v)
+			} else {
+				fmt.Printf("%s %f\n", metric_key(series_name(name, s), tags), s.v)
+			}
+		}
 	}
+	return nil
 }
-func (b *StdoutBackend) handleTiming(name string, td TimerDistribution) {
-    //write_to_timing_rrd(name, td.min, td.max, td.mean, td.q_50, td.q_90, td.count);
+func (b *StdoutBackend) handleTiming(name string, tags []string, td TimerDistribution) error {
+	if strings.HasPrefix(name, b.prefix) {
+		// Written at once so that the lines of other stdout backends
+		// flushing at the same time do not end up in the middle.
+		var line strings.Builder
+		fmt.Fprintf(&line, "%s count=%f mean=%f min=%f max=%f median=%f sum=%f sum_squares=%f std=%f", metric_key(name, tags),
+			td.count, td.mean, td.min, td.max, td.median, td.sum, td.sum_squares, td.stddev)
+		for _, p := range td.percentiles {
+			fmt.Fprintf(&line, " p%s=%f mean_%s=%f", percentile_name(p.p), p.v, percentile_name(p.p), p.mean)
+		}
+		for _, bin := range td.histogram {
+			fmt.Fprintf(&line, " %s=%f", bin_name(bin.upper), bin.count)
+		}
+		line.WriteString("\n")
+		os.Stdout.WriteString(line.String())
+	}
+	return nil
+}
+func (b *StdoutBackend) handleSet(name string, tags []string, count int64) error {
+	if strings.HasPrefix(name, b.prefix) {
+		fmt.Printf("%s %d\n", metric_key(name, tags), count)
+	}
+	return nil
 }
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// Tagged series are aggregated under a key made of the bucket name and
+// the sorted tag list, e.g. "api.requests#env:prod,host:a".
+const TAGS_SEPARATOR = "#"
+
+// parse_tags turns a DogStatsD tag list ("env:prod,host:a") into a
+// sorted list without duplicates or empty tags.
+func parse_tags(s string) []string {
+	if s == "" {
+		return nil
+	}
+	var tags []string
+	for _, tag := range strings.Split(s, ",") {
+		if tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	sort.Strings(tags)
+	uniq := tags[:0]
+	for i, tag := range tags {
+		if i == 0 || tag != tags[i-1] {
+			uniq = append(uniq, tag)
+		}
+	}
+	if len(uniq) == 0 {
+		return nil
+	}
+	return uniq
+}
+
+func metric_key(bucket string, tags []string) string {
+	if len(tags) == 0 {
+		return bucket
+	}
+	return bucket + TAGS_SEPARATOR + strings.Join(tags, ",")
+}
+
+func split_metric_key(key string) (string, []string) {
+	i := strings.Index(key, TAGS_SEPARATOR)
+	if i < 0 {
+		return key, nil
+	}
+	return key[:i], strings.Split(key[i+1:], ",")
+}
+
+// split_tag splits "env:prod" into its name and value; a bare tag has
+// an empty value.
+func split_tag(tag string) (string, string) {
+	i := strings.Index(tag, ":")
+	if i < 0 {
+		return tag, ""
+	}
+	return tag[:i], tag[i+1:]
+}
@@ -0,0 +1,69 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// SO_REUSEPORT is missing from the syscall package on most
+// architectures. 0xf is its value everywhere except mips, sparc and
+// parisc.
+const SO_REUSEPORT = 0xf
+
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	var err error
+	cerr := c.Control(func(fd uintptr) {
+		err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, SO_REUSEPORT, 1)
+	})
+	if cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+// readUdpKernelStats sums the receive queue size and the number of
+// datagrams dropped by the kernel over all UDP sockets bound to port.
+func readUdpKernelStats(port int) (rxQueue int64, drops int64, err error) {
+	found := false
+	for _, filename := range []string{"/proc/net/udp", "/proc/net/udp6"} {
+		f, err := os.Open(filename)
+		if err != nil {
+			continue
+		}
+		scanner := bufio.NewScanner(f)
+		scanner.Scan() // header
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) < 13 {
+				continue
+			}
+			// local_address is "ADDR:PORT" in hex
+			local := fields[1]
+			p, err := strconv.ParseInt(local[strings.LastIndex(local, ":")+1:], 16, 32)
+			if err != nil || int(p) != port {
+				continue
+			}
+			// tx_queue:rx_queue
+			queues := strings.Split(fields[4], ":")
+			if len(queues) == 2 {
+				q, _ := strconv.ParseInt(queues[1], 16, 64)
+				rxQueue += q
+			}
+			d, _ := strconv.ParseInt(fields[len(fields)-1], 10, 64)
+			drops += d
+			found = true
+		}
+		f.Close()
+	}
+	if !found {
+		return 0, 0, fmt.Errorf("no UDP sockets on port %d", port)
+	}
+	return rxQueue, drops, nil
+}
@@ -0,0 +1,17 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	return errors.New("SO_REUSEPORT is only supported on Linux")
+}
+
+func readUdpKernelStats(port int) (rxQueue int64, drops int64, err error) {
+	return 0, 0, errors.New("UDP kernel statistics are only available on Linux")
+}
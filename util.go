@@ -1,6 +1,11 @@
 package main;
 
-import "os"
+import (
+    "net"
+    "os"
+    "sync"
+    "time"
+)
 
 func file_exists(filename string) bool {
     if _, err := os.Stat(filename); err == nil {
@@ -8,3 +13,37 @@ func file_exists(filename string) bool {
     }
     return false
 }
+
+func addr_string(addr net.Addr) string {
+    if addr == nil {
+        return "unknown"
+    }
+    return addr.String()
+}
+
+// RateLimiter allows a limited number of events per wall-clock second.
+type RateLimiter struct {
+    lock sync.Mutex
+    second int64
+    count int
+}
+
+func NewRateLimiter() *RateLimiter {
+    var l RateLimiter
+    return &l
+}
+
+func (l *RateLimiter) allow(perSecond int) bool {
+    l.lock.Lock()
+    defer l.lock.Unlock()
+    now := time.Now().Unix()
+    if now != l.second {
+        l.second = now
+        l.count = 0
+    }
+    if l.count >= perSecond {
+        return false
+    }
+    l.count++
+    return true
+}